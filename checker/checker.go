@@ -0,0 +1,81 @@
+// Package checker interprets what checkers report: the metadata lines in
+// their logs, the results file and how their run ended. It is shared by the
+// web server and the command-line tools, so that they grade alike.
+package checker
+
+import (
+	"bytes"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+)
+
+// ParseMetadata returns the "@key value" lines found in the logs of a
+// checker, e.g. "@score 85". Later lines override earlier ones.
+func ParseMetadata(logs []byte) map[string]string {
+	metadata := map[string]string{}
+	lines := bytes.Split(logs, []byte("\n"))
+	for _, line := range lines {
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, []byte("@")) {
+			continue
+		}
+		line = bytes.TrimLeft(line, "@")
+		parts := bytes.SplitN(line, []byte(" "), 2)
+		if len(parts) != 2 {
+			continue
+		}
+		metadata[string(parts[0])] = string(parts[1])
+	}
+	return metadata
+}
+
+// Outcome is the evaluation of a run of a checker.
+type Outcome struct {
+	Status db.Status
+	// Error explains why the run failed.
+	Error string
+
+	Metadata map[string]string
+	Tests    []db.TestResult
+	Score    int
+}
+
+// Evaluate interprets the run of a checker, which produced `logs`, as
+// returned by scheduler.Submit. A run fails with an infrastructure error if it
+// couldn't be run, and with a checker error if the checker misbehaved, its
+// results are malformed or it reports no score. If `scoreOptional`, as for the
+// stages of a pipeline before the last one (e.g. a build), runs that report no
+// score but exit successfully score 0 instead. The score is kept even if the
+// run failed, for the caller to decide whether it counts.
+func Evaluate(response scheduler.SubmitResponse, logs []byte, err error, scoreOptional bool) Outcome {
+	if _, ok := err.(scheduler.CheckerError); ok {
+		return Outcome{Status: db.StatusCheckerError, Error: err.Error()}
+	}
+	if err != nil {
+		return Outcome{Status: db.StatusInfraError, Error: err.Error()}
+	}
+
+	outcome := Outcome{Metadata: ParseMetadata(logs)}
+	outcome.Tests, outcome.Score, err = ExtractResults(outcome.Metadata, response.Results)
+	if err == ErrNoScore && scoreOptional && response.ExitCode == 0 {
+		err = nil
+	}
+
+	switch {
+	case response.TimedOut:
+		outcome.Status = db.StatusTimedOut
+		outcome.Error = "time limit exceeded"
+	case response.Metrics.OOMKilled && (err != nil || response.ExitCode != 0):
+		// Processes killed by the checker itself don't count, as long
+		// as it still manages to report a score.
+		outcome.Status = db.StatusOOMKilled
+		outcome.Error = "memory limit exceeded"
+	case err != nil:
+		outcome.Status = db.StatusCheckerError
+		outcome.Error = err.Error()
+	default:
+		outcome.Status = db.StatusDone
+	}
+	return outcome
+}
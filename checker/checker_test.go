@@ -0,0 +1,182 @@
+package checker
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+)
+
+func TestParseMetadata(t *testing.T) {
+	tests := []struct {
+		logs string
+		want map[string]string
+	}{
+		{"", map[string]string{}},
+		{"@score 85\n", map[string]string{"score": "85"}},
+		{"  @score 85  \r\n@name  two words", map[string]string{"score": "85", "name": " two words"}},
+		{"@score 10\n@score 20\n", map[string]string{"score": "20"}},
+		{"score 85\n@alone\n", map[string]string{}},
+	}
+	for _, test := range tests {
+		got := ParseMetadata([]byte(test.logs))
+		if len(got) != len(test.want) {
+			t.Errorf("ParseMetadata(%q) = %v, want %v", test.logs, got, test.want)
+			continue
+		}
+		for key, value := range test.want {
+			if got[key] != value {
+				t.Errorf("ParseMetadata(%q) = %v, want %v", test.logs, got, test.want)
+			}
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		desc          string
+		response      scheduler.SubmitResponse
+		logs          string
+		err           error
+		scoreOptional bool
+		want          db.Status
+		wantScore     int
+	}{
+		{
+			desc: "score in logs",
+			logs: "@score 85\n",
+			want: db.StatusDone, wantScore: 85,
+		},
+		{
+			desc:     "results file takes precedence",
+			response: scheduler.SubmitResponse{Results: []byte(`{"tests": [{"name": "a", "status": "passed", "points": 7}]}`)},
+			logs:     "@score 85\n",
+			want:     db.StatusDone, wantScore: 7,
+		},
+		{
+			desc:     "malformed results file",
+			response: scheduler.SubmitResponse{Results: []byte(`{"tests": [{"status": "passed"}]}`)},
+			want:     db.StatusCheckerError,
+		},
+		{
+			desc: "non-integer score",
+			logs: "@score lots\n",
+			want: db.StatusCheckerError,
+		},
+		{
+			desc: "no score",
+			want: db.StatusCheckerError,
+		},
+		{
+			desc:          "no score, optional",
+			scoreOptional: true,
+			want:          db.StatusDone,
+		},
+		{
+			desc:          "no score, optional, but failed",
+			response:      scheduler.SubmitResponse{ExitCode: 2},
+			scoreOptional: true,
+			want:          db.StatusCheckerError,
+		},
+		{
+			desc:     "timed out",
+			response: scheduler.SubmitResponse{TimedOut: true},
+			logs:     "@score 10\n",
+			want:     db.StatusTimedOut, wantScore: 10,
+		},
+		{
+			desc:     "out of memory",
+			response: scheduler.SubmitResponse{ExitCode: 137, Metrics: scheduler.Metrics{OOMKilled: true}},
+			want:     db.StatusOOMKilled,
+		},
+		{
+			desc:     "out of memory, but the checker coped",
+			response: scheduler.SubmitResponse{Metrics: scheduler.Metrics{OOMKilled: true}},
+			logs:     "@score 50\n",
+			want:     db.StatusDone, wantScore: 50,
+		},
+		{
+			desc: "checker error",
+			err:  scheduler.CheckerError{Err: errors.New("results file too large")},
+			want: db.StatusCheckerError,
+		},
+		{
+			desc: "infrastructure error",
+			err:  scheduler.InfraError{Err: errors.New("connection reset")},
+			want: db.StatusInfraError,
+		},
+		{
+			desc: "config error",
+			err:  scheduler.ConfigError{Err: errors.New("bad ulimit")},
+			want: db.StatusInfraError,
+		},
+	}
+	for _, test := range tests {
+		outcome := Evaluate(test.response, []byte(test.logs), test.err, test.scoreOptional)
+		if outcome.Status != test.want || outcome.Score != test.wantScore {
+			t.Errorf("%v: got status %q and score %d (%v), want %q and %d", test.desc, outcome.Status, outcome.Score, outcome.Error, test.want, test.wantScore)
+		}
+		if outcome.Status.IsFailure() && outcome.Error == "" {
+			t.Errorf("%v: failed without an error", test.desc)
+		}
+	}
+}
+
+func TestParseResults(t *testing.T) {
+	tests := []struct {
+		results   string
+		wantTests int
+		wantScore int
+		wantErr   string
+	}{
+		{`{"tests": []}`, 0, 0, ""},
+		{`{"score": 85}`, 0, 85, ""},
+		{`{"tests": [{"name": "a", "status": "passed", "points": 5}, {"name": "b", "status": "failed"}]}`, 2, 5, ""},
+		{`{"score": 3, "tests": [{"name": "a", "status": "passed", "points": 5}]}`, 1, 3, ""},
+		{`{"score": 0, "tests": [{"name": "a", "status": "passed", "points": 5}]}`, 1, 0, ""},
+		{`[]`, 0, 0, "malformed results file"},
+		{`{"tests": [{"status": "passed"}]}`, 0, 0, "test #1 has no name"},
+		{`{"tests": [{"name": "a", "status": "ok"}]}`, 0, 0, `test "a" has bad status "ok"`},
+	}
+	for _, test := range tests {
+		got, score, err := ParseResults([]byte(test.results))
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("ParseResults(%s): got error %v, want %q", test.results, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || len(got) != test.wantTests || score != test.wantScore {
+			t.Errorf("ParseResults(%s) = %d tests, score %d, error %v; want %d tests, score %d", test.results, len(got), score, err, test.wantTests, test.wantScore)
+		}
+	}
+}
+
+func TestExtractResults(t *testing.T) {
+	tests := []struct {
+		desc      string
+		metadata  map[string]string
+		results   []byte
+		wantScore int
+		wantErr   error
+	}{
+		{"score line", map[string]string{"score": "85"}, nil, 85, nil},
+		{"results file over score line", map[string]string{"score": "85"}, []byte(`{"score": 7}`), 7, nil},
+		{"empty results file over score line", map[string]string{"score": "85"}, []byte(`{}`), 0, nil},
+		{"nothing reported", map[string]string{}, nil, 0, ErrNoScore},
+		{"other metadata only", map[string]string{"tests": "17/20"}, nil, 0, ErrNoScore},
+	}
+	for _, test := range tests {
+		_, score, err := ExtractResults(test.metadata, test.results)
+		if score != test.wantScore || err != test.wantErr {
+			t.Errorf("%v: got score %d and error %v, want %d and %v", test.desc, score, err, test.wantScore, test.wantErr)
+		}
+	}
+
+	// Scores that aren't integers are errors of their own.
+	if _, _, err := ExtractResults(map[string]string{"score": "lots"}, nil); err == nil || err == ErrNoScore {
+		t.Errorf("non-integer score: got error %v", err)
+	}
+}
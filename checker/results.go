@@ -0,0 +1,91 @@
+package checker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/AndreiDuma/lxchecker/db"
+)
+
+// checkerResults is the format of the results file checkers may write
+// (at scheduler.DefaultResultsPath), e.g.:
+//
+//	{
+//		"score": 85,
+//		"tests": [
+//			{"name": "init", "status": "passed", "points": 5, "max_points": 5, "duration": 0.2},
+//			{"name": "swap", "status": "failed", "points": 0, "max_points": 10, "message": "segfault"}
+//		]
+//	}
+//
+// The score is optional and defaults to the sum of the tests' points.
+type checkerResults struct {
+	Score *int `json:"score"`
+	Tests []struct {
+		Name      string  `json:"name"`
+		Status    string  `json:"status"`
+		Points    int     `json:"points"`
+		MaxPoints int     `json:"max_points"`
+		Message   string  `json:"message"`
+		Duration  float64 `json:"duration"` // in seconds
+	} `json:"tests"`
+}
+
+var validTestStatuses = map[string]bool{
+	"passed":  true,
+	"failed":  true,
+	"skipped": true,
+	"error":   true,
+}
+
+// ParseResults parses a results file, returning the tests and the score.
+func ParseResults(data []byte) ([]db.TestResult, int, error) {
+	results := checkerResults{}
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, 0, fmt.Errorf("malformed results file: %v", err)
+	}
+
+	tests := []db.TestResult{}
+	score := 0
+	for i, t := range results.Tests {
+		if t.Name == "" {
+			return nil, 0, fmt.Errorf("test #%d has no name", i+1)
+		}
+		if !validTestStatuses[t.Status] {
+			return nil, 0, fmt.Errorf("test %q has bad status %q", t.Name, t.Status)
+		}
+		tests = append(tests, db.TestResult{
+			Name:      t.Name,
+			Status:    t.Status,
+			Points:    t.Points,
+			MaxPoints: t.MaxPoints,
+			Message:   t.Message,
+			Duration:  time.Duration(t.Duration * float64(time.Second)),
+		})
+		score += t.Points
+	}
+	if results.Score != nil {
+		score = *results.Score
+	}
+	return tests, score, nil
+}
+
+// ErrNoScore is returned by ExtractResults for checkers reporting no score.
+var ErrNoScore = errors.New("no score reported")
+
+// ExtractResults returns the test results and the score reported by a
+// checker. The results file takes precedence over the "@score" line in the
+// logs, already parsed into `metadata`.
+func ExtractResults(metadata map[string]string, results []byte) ([]db.TestResult, int, error) {
+	if results != nil {
+		return ParseResults(results)
+	}
+	if _, ok := metadata["score"]; !ok {
+		return nil, 0, ErrNoScore
+	}
+	score, err := strconv.Atoi(metadata["score"])
+	return nil, score, err
+}
@@ -0,0 +1,47 @@
+// Package cli implements the subcommands of lxchecker, which run checkers
+// locally without MongoDB or the web server.
+package cli
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/AndreiDuma/lxchecker/scheduler"
+)
+
+// Defaults of the flags shared by the commands.
+const (
+	defaultSubmissionPath = "/submission/submission.zip"
+	defaultTimeout        = 5 * time.Minute
+)
+
+// newScheduler creates a scheduler running submissions with the executor
+// named `name`, configured through the environment as for the web server.
+func newScheduler(name string) (*scheduler.Scheduler, error) {
+	executor, err := scheduler.NewExecutor(name)
+	if err != nil {
+		return nil, err
+	}
+	return scheduler.New(executor), nil
+}
+
+// interruptibleContext returns a context cancelled on SIGINT or SIGTERM, so
+// that running containers are cleaned up before exiting.
+func interruptibleContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
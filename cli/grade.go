@@ -0,0 +1,238 @@
+package cli
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/AndreiDuma/lxchecker/checker"
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+)
+
+// gradeResult is the line of the report of Grade for a submission.
+type gradeResult struct {
+	File     string            `json:"file"`
+	Status   db.Status         `json:"status"`
+	Error    string            `json:"error,omitempty"`
+	Score    int               `json:"score"`
+	ExitCode int               `json:"exit_code"`
+	WallTime float64           `json:"wall_time"` // in seconds
+	Metadata map[string]string `json:"metadata"`
+}
+
+// Grade runs every file in a directory through a checker image as a
+// submission, several at a time, and writes a CSV or JSON report of their
+// scores and metadata. Neither MongoDB nor the web server are needed. It
+// exits with status 1 if any submission couldn't be graded because of the
+// infrastructure.
+func Grade(args []string) int {
+	flags := flag.NewFlagSet("grade", flag.ContinueOnError)
+	image := flags.String("image", "", "checker image (required)")
+	pullPolicy := flags.String("pull-policy", string(scheduler.PullIfMissing), "when to pull the image: always, if-missing or never")
+	submissionPath := flags.String("submission-path", defaultSubmissionPath, "where submissions are placed in the container")
+	timeout := flags.Duration("timeout", defaultTimeout, "time limit of each run")
+	parallel := flags.Int("parallel", 4, "number of submissions graded at the same time")
+	format := flags.String("format", "csv", "report format: csv or json")
+	output := flags.String("output", "", "report file (default standard output)")
+	executorName := flags.String("executor", os.Getenv("LXCHECKER_EXECUTOR"), "executor running the checker: docker, local or fake")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: lxchecker grade -image IMAGE [flags] DIR\n\n")
+		fmt.Fprintf(os.Stderr, "Grades every file in DIR as a submission and writes a report.\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *image == "" || flags.NArg() != 1 || *parallel <= 0 || (*format != "csv" && *format != "json") {
+		flags.Usage()
+		return 2
+	}
+	policy, err := scheduler.ParsePullPolicy(*pullPolicy)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	// Every regular file in the directory is a submission.
+	dir := flags.Arg(0)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	files := []string{}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			files = append(files, info.Name())
+		}
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "no submissions in %v\n", dir)
+		return 1
+	}
+
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	sched, err := newScheduler(*executorName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// Pull the image once rather than for every submission.
+	if _, err := sched.Pull(ctx, *image, policy); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if policy == scheduler.PullAlways {
+		policy = scheduler.PullIfMissing
+	}
+
+	results := make([]gradeResult, len(files))
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for i := range files {
+			select {
+			case next <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for w := 0; w < *parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				result := gradeFile(ctx, sched, filepath.Join(dir, files[i]), scheduler.SubmitOptions{
+					Image:          *image,
+					PullPolicy:     policy,
+					SubmissionPath: *submissionPath,
+					Timeout:        *timeout,
+				})
+				result.File = files[i]
+				results[i] = result
+
+				mu.Lock()
+				fmt.Fprintf(os.Stderr, "%v: %v, score %d\n", result.File, result.Status, result.Score)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "interrupted")
+		return 1
+	}
+
+	// Write the report.
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if *format == "json" {
+		err = writeJSONReport(w, results)
+	} else {
+		err = writeCSVReport(w, results)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write report: %v\n", err)
+		return 1
+	}
+
+	for _, result := range results {
+		if result.Status == db.StatusInfraError {
+			return 1
+		}
+	}
+	return 0
+}
+
+// gradeFile runs the submission in file `name` with `options`.
+func gradeFile(ctx context.Context, sched *scheduler.Scheduler, name string, options scheduler.SubmitOptions) gradeResult {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return gradeResult{Status: db.StatusInfraError, Error: err.Error()}
+	}
+	options.Submission = data
+	response, err := sched.Submit(ctx, options)
+	outcome := checker.Evaluate(response, response.Logs, err, false)
+	return gradeResult{
+		Status:   outcome.Status,
+		Error:    outcome.Error,
+		Score:    outcome.Score,
+		ExitCode: response.ExitCode,
+		WallTime: response.Metrics.WallTime.Seconds(),
+		Metadata: outcome.Metadata,
+	}
+}
+
+// writeJSONReport writes `results` as a JSON list.
+func writeJSONReport(w io.Writer, results []gradeResult) error {
+	encoded, err := json.MarshalIndent(results, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", encoded)
+	return err
+}
+
+// writeCSVReport writes `results` as CSV, with a column for each metadata
+// key reported for any of the submissions, e.g. "@score".
+func writeCSVReport(w io.Writer, results []gradeResult) error {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, result := range results {
+		for key := range result.Metadata {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	cw := csv.NewWriter(w)
+	header := []string{"file", "status", "score", "exit_code", "wall_time", "error"}
+	for _, key := range keys {
+		header = append(header, "@"+key)
+	}
+	cw.Write(header)
+	for _, result := range results {
+		record := []string{
+			result.File,
+			string(result.Status),
+			strconv.Itoa(result.Score),
+			strconv.Itoa(result.ExitCode),
+			strconv.FormatFloat(result.WallTime, 'f', 2, 64),
+			result.Error,
+		}
+		for _, key := range keys {
+			record = append(record, result.Metadata[key])
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
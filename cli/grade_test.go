@@ -0,0 +1,159 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+)
+
+var testResults = []gradeResult{
+	{
+		File:     "alice.zip",
+		Status:   db.StatusDone,
+		Score:    85,
+		WallTime: 1.5,
+		Metadata: map[string]string{"score": "85", "tests": "17/20"},
+	},
+	{
+		File:     "bob.zip",
+		Status:   db.StatusCheckerError,
+		Error:    "no score reported",
+		ExitCode: 1,
+		WallTime: 0.25,
+		Metadata: map[string]string{"warning": "a, \"quoted\" value"},
+	},
+}
+
+func TestWriteCSVReport(t *testing.T) {
+	tests := []struct {
+		desc    string
+		results []gradeResult
+		want    string
+	}{
+		{
+			desc:    "no submissions",
+			results: nil,
+			want:    "file,status,score,exit_code,wall_time,error\n",
+		},
+		{
+			desc:    "metadata columns of all submissions",
+			results: testResults,
+			want: "file,status,score,exit_code,wall_time,error,@score,@tests,@warning\n" +
+				"alice.zip,done,85,0,1.50,,85,17/20,\n" +
+				"bob.zip,checker_error,0,1,0.25,no score reported,,,\"a, \"\"quoted\"\" value\"\n",
+		},
+	}
+	for _, test := range tests {
+		buffer := new(bytes.Buffer)
+		if err := writeCSVReport(buffer, test.results); err != nil {
+			t.Errorf("%v: unexpected error %v", test.desc, err)
+			continue
+		}
+		if buffer.String() != test.want {
+			t.Errorf("%v: got\n%s\nwant\n%s", test.desc, buffer.String(), test.want)
+		}
+	}
+}
+
+func TestWriteJSONReport(t *testing.T) {
+	tests := []struct {
+		desc    string
+		results []gradeResult
+	}{
+		{"no submissions", []gradeResult{}},
+		{"submissions", testResults},
+	}
+	for _, test := range tests {
+		buffer := new(bytes.Buffer)
+		if err := writeJSONReport(buffer, test.results); err != nil {
+			t.Errorf("%v: unexpected error %v", test.desc, err)
+			continue
+		}
+		got := []gradeResult{}
+		if err := json.Unmarshal(buffer.Bytes(), &got); err != nil {
+			t.Errorf("%v: invalid JSON: %v", test.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.results) {
+			t.Errorf("%v: got %+v, want %+v", test.desc, got, test.results)
+		}
+	}
+}
+
+func TestGradeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lxchecker-grade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "alice.zip")
+	if err := ioutil.WriteFile(name, []byte("submission"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc      string
+		file      string
+		response  scheduler.SubmitResponse
+		err       error
+		wantScore int
+		want      db.Status
+	}{
+		{
+			desc:      "score reported",
+			file:      name,
+			response:  scheduler.SubmitResponse{Logs: []byte("@score 42\n")},
+			wantScore: 42,
+			want:      db.StatusDone,
+		},
+		{
+			desc:     "no score",
+			file:     name,
+			response: scheduler.SubmitResponse{Logs: []byte("all good\n")},
+			want:     db.StatusCheckerError,
+		},
+		{
+			desc:     "timed out",
+			file:     name,
+			response: scheduler.SubmitResponse{TimedOut: true},
+			want:     db.StatusTimedOut,
+		},
+		{
+			desc: "checker error",
+			file: name,
+			err:  scheduler.CheckerError{Err: errors.New("results file too large")},
+			want: db.StatusCheckerError,
+		},
+		{
+			desc: "missing file",
+			file: filepath.Join(dir, "missing.zip"),
+			want: db.StatusInfraError,
+		},
+	}
+	for _, test := range tests {
+		executor := scheduler.NewFakeExecutor()
+		test := test
+		executor.RunFunc = func(options scheduler.SubmitOptions) (scheduler.SubmitResponse, error) {
+			return test.response, test.err
+		}
+		result := gradeFile(context.Background(), scheduler.New(executor), test.file, scheduler.SubmitOptions{
+			Image: "lxchecker/test",
+		})
+		if result.Status != test.want || result.Score != test.wantScore {
+			t.Errorf("%v: got status %q and score %d (%v), want %q and %d", test.desc, result.Status, result.Score, result.Error, test.want, test.wantScore)
+		}
+		if test.want == db.StatusInfraError && len(executor.Runs()) != 0 {
+			t.Errorf("%v: ran a submission that couldn't be read", test.desc)
+		}
+	}
+}
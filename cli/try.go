@@ -0,0 +1,173 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/AndreiDuma/lxchecker/checker"
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+	"github.com/AndreiDuma/lxchecker/util"
+)
+
+// Limits applied to archives unpacked by Try, as for assignments that don't
+// set their own.
+const (
+	maxUnpackedSize  = 64 * 1024 * 1024
+	maxUnpackedFiles = 1000
+)
+
+// Try runs a checker image against a single submission as the server would,
+// for checker authors. It streams the logs, then prints the metadata, the
+// tests and the score parsed from them, with warnings about anything the
+// server would trip on. It exits with status 1 if the run failed or there
+// were warnings.
+func Try(args []string) int {
+	flags := flag.NewFlagSet("try", flag.ContinueOnError)
+	image := flags.String("image", "", "checker image (required)")
+	pullPolicy := flags.String("pull-policy", string(scheduler.PullIfMissing), "when to pull the image: always, if-missing or never")
+	submissionPath := flags.String("submission-path", defaultSubmissionPath, "where the submission is placed in the container")
+	timeout := flags.Duration("timeout", defaultTimeout, "time limit of the run")
+	command := flags.String("command", "", "command run with /bin/sh -c instead of the image's default one")
+	unpack := flags.Bool("unpack", false, "unpack archive submissions into the directory at -submission-path")
+	maxScore := flags.Int("max-score", 0, "maximum score by tests of the assignment, checked if set")
+	executorName := flags.String("executor", os.Getenv("LXCHECKER_EXECUTOR"), "executor running the checker: docker, local or fake")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: lxchecker try -image IMAGE [flags] SUBMISSION\n\n")
+		fmt.Fprintf(os.Stderr, "Grades the file SUBMISSION and shows what the checker reported.\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *image == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	policy, err := scheduler.ParsePullPolicy(*pullPolicy)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	name := flags.Arg(0)
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	options := scheduler.SubmitOptions{
+		Image:          *image,
+		PullPolicy:     policy,
+		Submission:     data,
+		SubmissionPath: *submissionPath,
+		Timeout:        *timeout,
+		Command:        *command,
+		Output:         os.Stdout,
+	}
+	// The output of failed attempts was already streamed, mark where the
+	// next one starts.
+	attempt := 1
+	options.Retrying = func(err error) {
+		attempt++
+		fmt.Printf("==> infrastructure error: %v\n==> retrying (attempt %d)\n", err, attempt)
+	}
+	if *unpack && util.IsArchive(name) {
+		files, err := util.ExtractArchive(name, data, maxUnpackedSize, maxUnpackedFiles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid archive: %v\n", err)
+			return 1
+		}
+		options.SubmissionFiles = files
+	}
+
+	ctx, cancel := interruptibleContext()
+	defer cancel()
+	sched, err := newScheduler(*executorName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("==> running %v on %v\n", *image, filepath.Base(name))
+	response, err := sched.Submit(ctx, options)
+	if ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, "interrupted")
+		return 1
+	}
+	outcome := checker.Evaluate(response, response.Logs, err, false)
+	if response.LogsTruncated {
+		fmt.Println("(logs truncated)")
+	}
+
+	fmt.Println("==> metadata")
+	keys := []string{}
+	for key := range outcome.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("@%v %v\n", key, outcome.Metadata[key])
+	}
+	if len(outcome.Tests) > 0 {
+		fmt.Println("==> tests")
+		for _, t := range outcome.Tests {
+			fmt.Printf("%-8v %v (%d/%d)", t.Status, t.Name, t.Points, t.MaxPoints)
+			if t.Message != "" {
+				fmt.Printf(": %v", t.Message)
+			}
+			fmt.Println()
+		}
+	}
+
+	fmt.Println("==> result")
+	fmt.Printf("status:     %v\n", outcome.Status)
+	if outcome.Error != "" {
+		fmt.Printf("error:      %v\n", outcome.Error)
+	}
+	fmt.Printf("score:      %d\n", outcome.Score)
+	fmt.Printf("exit code:  %d\n", response.ExitCode)
+	fmt.Printf("image:      %v\n", response.ImageDigest)
+	fmt.Printf("wall time:  %.2fs\n", response.Metrics.WallTime.Seconds())
+	fmt.Printf("CPU time:   %.2fs\n", response.Metrics.CPUTime.Seconds())
+	if response.Metrics.PeakMemory > 0 {
+		fmt.Printf("peak mem:   %d bytes\n", response.Metrics.PeakMemory)
+	}
+
+	warnings := tryWarnings(outcome, response, err, *maxScore)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", warning)
+	}
+	if outcome.Status != db.StatusDone || len(warnings) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// tryWarnings lists the problems with the score reported by a checker that
+// the server would silently turn into a failure or a wrong grade.
+func tryWarnings(outcome checker.Outcome, response scheduler.SubmitResponse, err error, maxScore int) []string {
+	if err != nil {
+		return nil
+	}
+	warnings := []string{}
+	if response.Results == nil {
+		score, ok := outcome.Metadata["score"]
+		if !ok {
+			warnings = append(warnings, "no @score line in the logs, the submission gets 0 points")
+		} else if _, err := strconv.Atoi(score); err != nil {
+			warnings = append(warnings, fmt.Sprintf("@score %q is not an integer", score))
+		}
+	} else if _, ok := outcome.Metadata["score"]; ok {
+		warnings = append(warnings, "@score is ignored, since the checker wrote a results file")
+	}
+	if maxScore > 0 && outcome.Score > maxScore {
+		warnings = append(warnings, fmt.Sprintf("score %d exceeds the maximum score by tests, %d", outcome.Score, maxScore))
+	}
+	return warnings
+}
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/AndreiDuma/lxchecker/checker"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+)
+
+func TestTryWarnings(t *testing.T) {
+	tests := []struct {
+		desc     string
+		outcome  checker.Outcome
+		response scheduler.SubmitResponse
+		err      error
+		maxScore int
+		want     []string
+	}{
+		{
+			desc:    "valid score",
+			outcome: checker.Outcome{Metadata: map[string]string{"score": "85"}, Score: 85},
+			want:    []string{},
+		},
+		{
+			desc: "no score",
+			want: []string{"no @score line in the logs, the submission gets 0 points"},
+		},
+		{
+			desc:    "score not an integer",
+			outcome: checker.Outcome{Metadata: map[string]string{"score": "8.5"}},
+			want:    []string{`@score "8.5" is not an integer`},
+		},
+		{
+			desc:     "score in logs and results file",
+			outcome:  checker.Outcome{Metadata: map[string]string{"score": "85"}, Score: 90},
+			response: scheduler.SubmitResponse{Results: []byte(`{"score": 90}`)},
+			want:     []string{"@score is ignored, since the checker wrote a results file"},
+		},
+		{
+			desc:     "score above the maximum",
+			outcome:  checker.Outcome{Metadata: map[string]string{"score": "120"}, Score: 120},
+			maxScore: 100,
+			want:     []string{"score 120 exceeds the maximum score by tests, 100"},
+		},
+		{
+			desc: "infrastructure error",
+			err:  errors.New("no such image"),
+		},
+	}
+	for _, test := range tests {
+		got := tryWarnings(test.outcome, test.response, test.err, test.maxScore)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got warnings %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
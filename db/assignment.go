@@ -14,9 +14,59 @@ type Assignment struct {
 
 	Name           string
 	Image          string
+	PullPolicy     string `bson:"pull_policy"`   // "always", "if-missing" or "never"
+	BuildVersion   int    `bson:"build_version"` // of the last image built by lxchecker, if any
 	Timeout        time.Duration
 	SubmissionPath string `bson:"submission_path"`
 
+	// Rules uploads are checked against. Archives are unpacked into the
+	// directory at SubmissionPath if Unpack is set. File patterns are
+	// globs, matched against base names unless they contain a slash.
+	Unpack            bool
+	RequiredFiles     []string `bson:"required_files"`
+	ForbiddenFiles    []string `bson:"forbidden_files"`
+	MaxSubmissionSize int64    `bson:"max_submission_size"` // in bytes, 0 means the default
+	MaxFileCount      int      `bson:"max_file_count"`      // 0 means the default
+
+	// Cap on the logs kept from each run, in bytes. 0 means the default.
+	MaxLogSize int64 `bson:"max_log_size"`
+
+	// Resource limits of the grading container. Zero means no limit.
+	MemoryLimit int64   `bson:"memory_limit"` // in bytes
+	CPULimit    float64 `bson:"cpu_limit"`    // in CPUs
+	PidsLimit   int64   `bson:"pids_limit"`
+	Ulimits     []Ulimit
+	TmpfsSize   int64 `bson:"tmpfs_size"` // in bytes, for the tmpfs mounted at /tmp
+	DiskSize    int64 `bson:"disk_size"`  // in bytes, for the container's filesystem
+
+	// Overrides of the hardened confinement of the grading container, for
+	// checkers that need more. The zero values keep the defaults: running
+	// as nobody, without capabilities, with the default seccomp profile
+	// and a read-only root filesystem.
+	User           string
+	CapAdd         []string `bson:"cap_add"`
+	WritableRootfs bool     `bson:"writable_rootfs"`
+	SeccompProfile string   `bson:"seccomp_profile"` // JSON, or "unconfined"
+
+	// Internal Docker network the grading container is attached to. Empty
+	// means networking is disabled.
+	Network string
+
+	// Files or directories collected from the grading container after it
+	// exits.
+	Artifacts []ArtifactSpec
+
+	// Private test fixtures, an archive stored as a file and unpacked into
+	// the directory at FixturesPath of the grading container when it runs,
+	// so that they don't have to be baked into the image.
+	FixturesFileId   string `bson:"fixtures_file_id"`
+	FixturesFileName string `bson:"fixtures_file_name"`
+	FixturesPath     string `bson:"fixtures_path"`
+
+	// Grading pipeline, run in order. Without stages, the image is run
+	// once with the settings above.
+	Stages []Stage
+
 	SoftDeadline time.Time `bson:"soft_deadline"`
 	HardDeadline time.Time `bson:"hard_deadline"`
 	DailyPenalty int       `bson:"daily_penalty"`
@@ -25,6 +75,37 @@ type Assignment struct {
 	MaxScoreByTeacher int `bson:"max_score_by_teacher"`
 }
 
+// ArtifactSpec describes a file or directory to collect from the grading
+// container.
+type ArtifactSpec struct {
+	Path string
+	// Public artifacts are visible to students, the others only to
+	// teachers.
+	Public bool
+}
+
+// Stage is a step of an assignment's grading pipeline, e.g. building or
+// functional tests. Each stage runs in a fresh container with the
+// submission.
+type Stage struct {
+	Name    string
+	Image   string        // empty means the assignment's image
+	Command string        // run with /bin/sh -c, empty means the image's default
+	Timeout time.Duration // 0 means the assignment's timeout
+	// Weight multiplies the score reported by the stage.
+	Weight float64
+	// StopOnFailure skips the remaining stages if this one fails.
+	StopOnFailure bool `bson:"stop_on_failure"`
+}
+
+// Ulimit describes a resource limit set with setrlimit(2) in the grading
+// container, e.g. "nofile" or "fsize".
+type Ulimit struct {
+	Name string
+	Soft int64
+	Hard int64
+}
+
 func GetAssignment(subjectId, id string) (*Assignment, error) {
 	assignment := Assignment{}
 	c := mongo.DB("lxchecker").C("assignments")
@@ -70,3 +151,36 @@ func InsertAssignment(a Assignment) error {
 	}
 	return nil
 }
+
+// UpdateAssignmentImage sets the checker image of an assignment and its pull
+// policy, leaving other fields to concurrent updates (e.g. of builds).
+func UpdateAssignmentImage(subjectId, id, image, pullPolicy string) error {
+	return updateAssignment(subjectId, id, bson.M{
+		"image":       image,
+		"pull_policy": pullPolicy,
+	})
+}
+
+// UpdateAssignmentFixtures sets the test fixtures of `a` to its
+// FixturesFileId, FixturesFileName and FixturesPath.
+func UpdateAssignmentFixtures(a *Assignment) error {
+	return updateAssignment(a.SubjectId, a.Id, bson.M{
+		"fixtures_file_id":   a.FixturesFileId,
+		"fixtures_file_name": a.FixturesFileName,
+		"fixtures_path":      a.FixturesPath,
+	})
+}
+
+func updateAssignment(subjectId, id string, fields bson.M) error {
+	c := mongo.DB("lxchecker").C("assignments")
+	if err := c.Update(bson.M{
+		"subject_id": subjectId,
+		"id":         id,
+	}, bson.M{"$set": fields}); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		panic(err)
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Statuses of a build.
+const (
+	BuildRunning = "running"
+	BuildDone    = "done"
+	BuildFailed  = "failed"
+)
+
+// Build is the building of an assignment's checker image from a bundle
+// uploaded by a teacher. Each build is a new version of the image.
+type Build struct {
+	Id           string
+	SubjectId    string `bson:"subject_id"`
+	AssignmentId string `bson:"assignment_id"`
+	Version      int
+
+	RequestedBy    string `bson:"requested_by"`
+	Timestamp      time.Time
+	BundleFileId   string `bson:"bundle_file_id"`
+	BundleFileName string `bson:"bundle_file_name"`
+
+	Tag         string // of the built image
+	Status      string
+	Logs        []byte
+	Error       string
+	ImageDigest string    `bson:"image_digest"`
+	FinishedAt  time.Time `bson:"finished_at"`
+}
+
+func NewBuildId() string {
+	return bson.NewObjectId().Hex()
+}
+
+func GetBuild(subjectId, assignmentId, id string) (*Build, error) {
+	build := Build{}
+	c := mongo.DB("lxchecker").C("builds")
+	if err := c.Find(bson.M{
+		"subject_id":    subjectId,
+		"assignment_id": assignmentId,
+		"id":            id,
+	}).One(&build); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		panic(err)
+	}
+	return &build, nil
+}
+
+// GetBuilds returns the builds of an assignment, latest first, without their
+// logs.
+func GetBuilds(subjectId, assignmentId string) []Build {
+	builds := []Build{}
+	c := mongo.DB("lxchecker").C("builds")
+	if err := c.Find(bson.M{
+		"subject_id":    subjectId,
+		"assignment_id": assignmentId,
+	}).Select(bson.M{"logs": 0}).Sort("-version").All(&builds); err != nil {
+		panic(err)
+	}
+	return builds
+}
+
+// InsertBuild inserts `b` as the next version of its assignment's image,
+// setting b.Version.
+func InsertBuild(b *Build) error {
+	c := mongo.DB("lxchecker").C("builds")
+	for {
+		latest := Build{}
+		err := c.Find(bson.M{
+			"subject_id":    b.SubjectId,
+			"assignment_id": b.AssignmentId,
+		}).Sort("-version").One(&latest)
+		if err != nil && err != mgo.ErrNotFound {
+			panic(err)
+		}
+		b.Version = latest.Version + 1
+
+		// another build may have taken the version meanwhile
+		if err := c.Insert(b); err != nil {
+			if mgo.IsDup(err) {
+				continue
+			}
+			panic(err)
+		}
+		return nil
+	}
+}
+
+// UpdateBuildLogs only updates the logs of a build, so that it can be
+// followed.
+func UpdateBuildLogs(b *Build) error {
+	c := mongo.DB("lxchecker").C("builds")
+	if err := c.Update(bson.M{
+		"subject_id":    b.SubjectId,
+		"assignment_id": b.AssignmentId,
+		"id":            b.Id,
+	}, bson.M{
+		"$set": bson.M{"logs": b.Logs},
+	}); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		panic(err)
+	}
+	return nil
+}
+
+func UpdateBuild(b *Build) error {
+	c := mongo.DB("lxchecker").C("builds")
+	if err := c.Update(bson.M{
+		"subject_id":    b.SubjectId,
+		"assignment_id": b.AssignmentId,
+		"id":            b.Id,
+	}, b); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		panic(err)
+	}
+	return nil
+}
+
+// FailInterruptedBuilds marks builds left running, e.g. by a restart of the
+// server, as failed.
+func FailInterruptedBuilds() {
+	c := mongo.DB("lxchecker").C("builds")
+	if _, err := c.UpdateAll(bson.M{
+		"status": BuildRunning,
+	}, bson.M{
+		"$set": bson.M{"status": BuildFailed, "error": "interrupted", "finished_at": time.Now()},
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// UseBuild switches the assignment of `b` to its image, which can't be pulled,
+// unless the assignment already uses a later version. ErrNotFound is returned
+// in that case.
+func UseBuild(b *Build) error {
+	c := mongo.DB("lxchecker").C("assignments")
+	if err := c.Update(bson.M{
+		"subject_id":    b.SubjectId,
+		"id":            b.AssignmentId,
+		"build_version": bson.M{"$lt": b.Version},
+	}, bson.M{
+		"$set": bson.M{
+			"image":         b.Tag,
+			"pull_policy":   "never",
+			"build_version": b.Version,
+		},
+	}); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		panic(err)
+	}
+	return nil
+}
+
+// GetBuildsInUse returns the builds whose image is used by their assignment,
+// without their logs.
+func GetBuildsInUse() []Build {
+	assignments := []Assignment{}
+	if err := mongo.DB("lxchecker").C("assignments").Find(bson.M{
+		"build_version": bson.M{"$gt": 0},
+	}).Select(bson.M{
+		"subject_id":    1,
+		"id":            1,
+		"image":         1,
+		"build_version": 1,
+	}).All(&assignments); err != nil {
+		panic(err)
+	}
+	builds := []Build{}
+	c := mongo.DB("lxchecker").C("builds")
+	for _, a := range assignments {
+		b := Build{}
+		if err := c.Find(bson.M{
+			"subject_id":    a.SubjectId,
+			"assignment_id": a.Id,
+			"version":       a.BuildVersion,
+			"status":        BuildDone,
+		}).Select(bson.M{"logs": 0}).One(&b); err != nil {
+			if err == mgo.ErrNotFound {
+				continue
+			}
+			panic(err)
+		}
+		// the image may have been changed by hand since
+		if b.Tag == a.Image {
+			builds = append(builds, b)
+		}
+	}
+	return builds
+}
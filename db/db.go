@@ -5,6 +5,7 @@ import (
 	"log"
 
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var (
@@ -51,4 +52,97 @@ func Init() {
 	}); err != nil {
 		log.Fatalln("failed to ensure an unique index on collection `teachers`, keys `username`, `subject_id`")
 	}
+	if err = mongo.DB("lxchecker").C("jobs").EnsureIndex(mgo.Index{
+		Key:    []string{"id"},
+		Unique: true,
+	}); err != nil {
+		log.Fatalln("failed to ensure an unique index on collection `jobs`, key `id`")
+	}
+	if err = mongo.DB("lxchecker").C("jobs").EnsureIndex(mgo.Index{
+		Key:    []string{"submission_id"},
+		Unique: true,
+	}); err != nil {
+		log.Fatalln("failed to ensure an unique index on collection `jobs`, key `submission_id`")
+	}
+	if err = mongo.DB("lxchecker").C("submissions").EnsureIndexKey("status"); err != nil {
+		log.Fatalln("failed to ensure an index on collection `submissions`, key `status`")
+	}
+	if err = mongo.DB("lxchecker").C("jobs").EnsureIndexKey("status", "priority", "timestamp"); err != nil {
+		log.Fatalln("failed to ensure an index on collection `jobs`, keys `status`, `priority`, `timestamp`")
+	}
+	if err = mongo.DB("lxchecker").C("regrades").EnsureIndex(mgo.Index{
+		Key:    []string{"id", "assignment_id", "subject_id"},
+		Unique: true,
+	}); err != nil {
+		log.Fatalln("failed to ensure an unique index on collection `regrades`, keys `id`, `assignment_id` and `subject_id`")
+	}
+	if err = mongo.DB("lxchecker").C("job_claims").EnsureIndex(mgo.Index{
+		Key:    []string{"username"},
+		Unique: true,
+	}); err != nil {
+		log.Fatalln("failed to ensure an unique index on collection `job_claims`, key `username`")
+	}
+	if err = mongo.DB("lxchecker").C("jobs").EnsureIndexKey("owner_username"); err != nil {
+		log.Fatalln("failed to ensure an index on collection `jobs`, key `owner_username`")
+	}
+	if err = mongo.DB("lxchecker").C("job_slots").EnsureIndex(mgo.Index{
+		Key:    []string{"key"},
+		Unique: true,
+	}); err != nil {
+		log.Fatalln("failed to ensure an unique index on collection `job_slots`, key `key`")
+	}
+	if err = mongo.DB("lxchecker").C("job_slots").EnsureIndexKey("jobs"); err != nil {
+		log.Fatalln("failed to ensure an index on collection `job_slots`, key `jobs`")
+	}
+	if err = mongo.DB("lxchecker").C("builds").EnsureIndex(mgo.Index{
+		Key:    []string{"id", "assignment_id", "subject_id"},
+		Unique: true,
+	}); err != nil {
+		log.Fatalln("failed to ensure an unique index on collection `builds`, keys `id`, `assignment_id` and `subject_id`")
+	}
+	if err = mongo.DB("lxchecker").C("builds").EnsureIndex(mgo.Index{
+		Key:    []string{"subject_id", "assignment_id", "version"},
+		Unique: true,
+	}); err != nil {
+		log.Fatalln("failed to ensure an unique index on collection `builds`, keys `subject_id`, `assignment_id` and `version`")
+	}
+
+	// Rename statuses of submissions made before statuses were typed.
+	for old, status := range map[string]Status{
+		"pending": StatusQueued,
+		"failed":  StatusCheckerError,
+	} {
+		if _, err = mongo.DB("lxchecker").C("submissions").UpdateAll(
+			bson.M{"status": old},
+			bson.M{"$set": bson.M{"status": status}},
+		); err != nil {
+			log.Fatalf("failed to migrate submissions with status `%v`\n", old)
+		}
+	}
+
+	// Assignments made before pull policies had their image pulled before
+	// every run.
+	if _, err = mongo.DB("lxchecker").C("assignments").UpdateAll(
+		bson.M{"pull_policy": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"pull_policy": "always"}},
+	); err != nil {
+		log.Fatalln("failed to migrate assignments without a pull policy")
+	}
+
+	// Assignments made before checkers were confined ran them as root on a
+	// writable root filesystem, which their checkers may rely on.
+	if _, err = mongo.DB("lxchecker").C("assignments").UpdateAll(
+		bson.M{"user": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"user": "root", "writable_rootfs": true}},
+	); err != nil {
+		log.Fatalln("failed to migrate assignments without a security profile")
+	}
+
+	// Assignments made before builds never used one.
+	if _, err = mongo.DB("lxchecker").C("assignments").UpdateAll(
+		bson.M{"build_version": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"build_version": 0}},
+	); err != nil {
+		log.Fatalln("failed to migrate assignments without a build version")
+	}
 }
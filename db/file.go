@@ -0,0 +1,57 @@
+package db
+
+import (
+	"io/ioutil"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Files too large to be kept inside documents (e.g. artifacts collected from
+// grading containers) are stored in GridFS and referred to by id.
+
+func InsertFile(name string, data []byte) string {
+	f, err := mongo.DB("lxchecker").GridFS("fs").Create(name)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		panic(err)
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+	return f.Id().(bson.ObjectId).Hex()
+}
+
+func GetFile(id string) ([]byte, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+	f, err := mongo.DB("lxchecker").GridFS("fs").OpenId(bson.ObjectIdHex(id))
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		panic(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		panic(err)
+	}
+	return data, nil
+}
+
+func RemoveFile(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFound
+	}
+	if err := mongo.DB("lxchecker").GridFS("fs").RemoveId(bson.ObjectIdHex(id)); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		panic(err)
+	}
+	return nil
+}
@@ -0,0 +1,558 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCancelled = "cancelled" // still running, but should be stopped
+)
+
+// Job priorities. Jobs with a lower priority value run first.
+const (
+	JobPriorityInteractive = 0 // submissions uploaded by students
+	JobPriorityBulk        = 1 // e.g. regrades started by teachers
+)
+
+// Job describes a submission waiting to be (or being) run by a worker.
+type Job struct {
+	Id           string
+	SubjectId    string `bson:"subject_id"`
+	AssignmentId string `bson:"assignment_id"`
+	SubmissionId string `bson:"submission_id"`
+
+	OwnerUsername string `bson:"owner_username"`
+	Priority      int
+
+	Status    string
+	WorkerId  string `bson:"worker_id"`
+	Timestamp time.Time
+	Heartbeat time.Time
+	Attempts  int
+}
+
+func NewJobId() string {
+	return bson.NewObjectId().Hex()
+}
+
+func InsertJob(j *Job) error {
+	if j.Status == "" {
+		j.Status = JobQueued
+	}
+	if j.Timestamp.IsZero() {
+		j.Timestamp = time.Now()
+	}
+	c := mongo.DB("lxchecker").C("jobs")
+	if err := c.Insert(j); err != nil {
+		if mgo.IsDup(err) {
+			return ErrAlreadyExists
+		}
+		panic(err)
+	}
+	return nil
+}
+
+// ClaimLimits bounds the number of jobs running at the same time. Zero means
+// no limit.
+type ClaimLimits struct {
+	MaxPerUser       int
+	MaxPerAssignment int
+}
+
+// ClaimJob marks a queued job as running on behalf of `workerId` and returns
+// it. Jobs are picked by priority first; within a priority, users take turns,
+// the one served least recently going first, and each user's jobs run in the
+// order they were queued. Jobs of users or assignments at their limit are
+// skipped. ErrNotFound is returned if there's nothing to run.
+func ClaimJob(workerId string, limits ClaimLimits) (*Job, error) {
+	c := mongo.DB("lxchecker").C("jobs")
+
+	// Leave out users and assignments at their limit.
+	var fullUsers, fullAssignments []jobSlots
+	if limits.MaxPerUser > 0 {
+		fullUsers = getFullSlots("username", limits.MaxPerUser)
+	}
+	if limits.MaxPerAssignment > 0 {
+		fullAssignments = getFullSlots("assignment_id", limits.MaxPerAssignment)
+	}
+
+	// Find the oldest job of each user, in the best priority.
+	type firstJob struct {
+		Job Job
+	}
+	firstJobs := []firstJob{}
+	if err := c.Pipe([]bson.M{
+		{"$match": queuedJobsMatch(fullUsers, fullAssignments)},
+		{"$sort": bson.D{{Name: "priority", Value: 1}, {Name: "timestamp", Value: 1}}},
+		{"$group": bson.M{
+			"_id": "$owner_username",
+			"job": bson.M{"$first": "$$ROOT"},
+		}},
+	}).All(&firstJobs); err != nil {
+		panic(err)
+	}
+	jobs := []Job{}
+	for _, first := range firstJobs {
+		jobs = append(jobs, first.Job)
+	}
+	candidates := bestPriorityJobs(jobs)
+	if len(candidates) == 0 {
+		return nil, ErrNotFound
+	}
+	usernames := []string{}
+	for _, candidate := range candidates {
+		usernames = append(usernames, candidate.OwnerUsername)
+	}
+	job := nextJob(candidates, getLastClaims(usernames))
+
+	now := time.Now()
+	if _, err := c.Find(bson.M{"id": job.Id, "status": JobQueued}).Apply(mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{
+				"status":    JobRunning,
+				"worker_id": workerId,
+				"heartbeat": now,
+			},
+			"$inc": bson.M{"attempts": 1},
+		},
+		ReturnNew: true,
+	}, job); err != nil {
+		if err == mgo.ErrNotFound {
+			// Claimed or cancelled meanwhile.
+			return nil, ErrNotFound
+		}
+		panic(err)
+	}
+
+	// The limits are only enforced here, as other processes may be
+	// claiming jobs too.
+	if !reserveSlots(job, limits) {
+		// Someone else reached the limit first, put the job back.
+		if err := c.Update(bson.M{
+			"id":        job.Id,
+			"status":    JobRunning,
+			"worker_id": workerId,
+		}, bson.M{
+			"$set": bson.M{"status": JobQueued, "worker_id": ""},
+			"$inc": bson.M{"attempts": -1},
+		}); err != nil && err != mgo.ErrNotFound {
+			panic(err)
+		}
+		return nil, ErrNotFound
+	}
+	setLastClaim(job.OwnerUsername, now)
+	return job, nil
+}
+
+// queuedJobsMatch matches the queued jobs of users and assignments whose
+// slots aren't among the full ones.
+func queuedJobsMatch(fullUsers, fullAssignments []jobSlots) bson.M {
+	match := bson.M{"status": JobQueued}
+	if len(fullUsers) > 0 {
+		usernames := []string{}
+		for _, slots := range fullUsers {
+			usernames = append(usernames, slots.Username)
+		}
+		match["owner_username"] = bson.M{"$nin": usernames}
+	}
+	if len(fullAssignments) > 0 {
+		assignments := []bson.M{}
+		for _, slots := range fullAssignments {
+			assignments = append(assignments, bson.M{
+				"subject_id":    slots.SubjectId,
+				"assignment_id": slots.AssignmentId,
+			})
+		}
+		match["$nor"] = assignments
+	}
+	return match
+}
+
+// bestPriorityJobs returns the jobs of `jobs` in the best priority.
+func bestPriorityJobs(jobs []Job) []*Job {
+	best := []*Job{}
+	for i := range jobs {
+		j := &jobs[i]
+		if len(best) > 0 && j.Priority > best[0].Priority {
+			continue
+		}
+		if len(best) > 0 && j.Priority < best[0].Priority {
+			best = best[:0]
+		}
+		best = append(best, j)
+	}
+	return best
+}
+
+// nextJob returns the job of `candidates` whose user's turn it is: the one
+// served least recently according to `lastClaims`, users never served going
+// first. Ties are broken by queueing time.
+func nextJob(candidates []*Job, lastClaims map[string]time.Time) *Job {
+	var job *Job
+	for _, candidate := range candidates {
+		if job == nil {
+			job = candidate
+			continue
+		}
+		last, bestLast := lastClaims[candidate.OwnerUsername], lastClaims[job.OwnerUsername]
+		if last.Before(bestLast) || last.Equal(bestLast) && candidate.Timestamp.Before(job.Timestamp) {
+			job = candidate
+		}
+	}
+	return job
+}
+
+// jobSlots lists the jobs running for a user or for an assignment, so that
+// their number can be bounded atomically.
+type jobSlots struct {
+	Key          string // "user:<username>" or "assignment:<subject>/<assignment>"
+	Username     string `bson:"username,omitempty"`
+	SubjectId    string `bson:"subject_id,omitempty"`
+	AssignmentId string `bson:"assignment_id,omitempty"`
+	Jobs         []string
+}
+
+// getFullSlots returns the slots of users (if `field` is "username") or
+// assignments (if "assignment_id") holding at least `limit` jobs.
+func getFullSlots(field string, limit int) []jobSlots {
+	slots := []jobSlots{}
+	if err := mongo.DB("lxchecker").C("job_slots").Find(bson.M{
+		field:                           bson.M{"$exists": true},
+		fmt.Sprintf("jobs.%d", limit-1): bson.M{"$exists": true},
+	}).All(&slots); err != nil {
+		panic(err)
+	}
+	return slots
+}
+
+// userSlots returns the slots of the user of job `j`.
+func userSlots(j *Job) jobSlots {
+	return jobSlots{
+		Key:      "user:" + j.OwnerUsername,
+		Username: j.OwnerUsername,
+	}
+}
+
+// assignmentSlots returns the slots of the assignment of job `j`.
+func assignmentSlots(j *Job) jobSlots {
+	return jobSlots{
+		Key:          fmt.Sprintf("assignment:%v/%v", j.SubjectId, j.AssignmentId),
+		SubjectId:    j.SubjectId,
+		AssignmentId: j.AssignmentId,
+	}
+}
+
+// reserveSlots records running job `j` in the slots of its user and its
+// assignment, unless either of them is at its limit.
+func reserveSlots(j *Job, limits ClaimLimits) bool {
+	if !reserveSlot(userSlots(j), j.Id, limits.MaxPerUser) {
+		return false
+	}
+	if !reserveSlot(assignmentSlots(j), j.Id, limits.MaxPerAssignment) {
+		releaseSlots(j.Id)
+		return false
+	}
+	return true
+}
+
+// slotQuery matches `slots` as long as they hold fewer than `limit` jobs (if
+// non-zero).
+func slotQuery(slots jobSlots, limit int) bson.M {
+	query := bson.M{"key": slots.Key}
+	if slots.Username != "" {
+		query["username"] = slots.Username
+	} else {
+		query["subject_id"] = slots.SubjectId
+		query["assignment_id"] = slots.AssignmentId
+	}
+	if limit > 0 {
+		query[fmt.Sprintf("jobs.%d", limit-1)] = bson.M{"$exists": false}
+	}
+	return query
+}
+
+// reserveSlot adds `jobId` to `slots`, provided they hold fewer than `limit`
+// jobs (if non-zero).
+func reserveSlot(slots jobSlots, jobId string, limit int) bool {
+	// If the slots are full, the upsert tries to insert them again and
+	// breaks the unique index on `key`.
+	if _, err := mongo.DB("lxchecker").C("job_slots").Upsert(slotQuery(slots, limit), bson.M{
+		"$addToSet": bson.M{"jobs": jobId},
+	}); err != nil {
+		if mgo.IsDup(err) {
+			return false
+		}
+		panic(err)
+	}
+	return true
+}
+
+// releaseSlots removes job `jobId` from the slots it holds.
+func releaseSlots(jobId string) {
+	if _, err := mongo.DB("lxchecker").C("job_slots").UpdateAll(bson.M{
+		"jobs": jobId,
+	}, bson.M{
+		"$pull": bson.M{"jobs": jobId},
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// pruneSlots releases the slots of jobs no longer running, e.g. because the
+// server stopped before releasing them, and removes empty slots.
+func pruneSlots() {
+	slotsC := mongo.DB("lxchecker").C("job_slots")
+	jobIds := []string{}
+	if err := slotsC.Find(nil).Distinct("jobs", &jobIds); err != nil {
+		panic(err)
+	}
+	// Jobs are marked as running before taking their slots.
+	running := []string{}
+	if err := mongo.DB("lxchecker").C("jobs").Find(bson.M{
+		"id":     bson.M{"$in": jobIds},
+		"status": bson.M{"$in": []string{JobRunning, JobCancelled}},
+	}).Distinct("id", &running); err != nil {
+		panic(err)
+	}
+	isRunning := map[string]bool{}
+	for _, id := range running {
+		isRunning[id] = true
+	}
+	stale := []string{}
+	for _, id := range jobIds {
+		if !isRunning[id] {
+			stale = append(stale, id)
+		}
+	}
+	if len(stale) > 0 {
+		if _, err := slotsC.UpdateAll(bson.M{
+			"jobs": bson.M{"$in": stale},
+		}, bson.M{
+			"$pull": bson.M{"jobs": bson.M{"$in": stale}},
+		}); err != nil {
+			panic(err)
+		}
+	}
+	if _, err := slotsC.RemoveAll(bson.M{"jobs": bson.M{"$size": 0}}); err != nil {
+		panic(err)
+	}
+}
+
+// getLastClaims returns when a job of each of `usernames` was last claimed.
+func getLastClaims(usernames []string) map[string]time.Time {
+	type lastClaim struct {
+		Username  string
+		Timestamp time.Time
+	}
+	claims := []lastClaim{}
+	if err := mongo.DB("lxchecker").C("job_claims").Find(bson.M{
+		"username": bson.M{"$in": usernames},
+	}).All(&claims); err != nil {
+		panic(err)
+	}
+	lastClaims := map[string]time.Time{}
+	for _, claim := range claims {
+		lastClaims[claim.Username] = claim.Timestamp
+	}
+	return lastClaims
+}
+
+func setLastClaim(username string, t time.Time) {
+	if _, err := mongo.DB("lxchecker").C("job_claims").Upsert(bson.M{
+		"username": username,
+	}, bson.M{
+		"$set": bson.M{"timestamp": t},
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// jobRemoved releases the slots of removed job `j`, and forgets when its
+// user was last served if they have no jobs left, users new to the queue
+// being served first anyway.
+func jobRemoved(j *Job) {
+	releaseSlots(j.Id)
+	n, err := mongo.DB("lxchecker").C("jobs").Find(bson.M{"owner_username": j.OwnerUsername}).Count()
+	if err != nil {
+		panic(err)
+	}
+	if n > 0 {
+		return
+	}
+	if err := mongo.DB("lxchecker").C("job_claims").Remove(bson.M{
+		"username": j.OwnerUsername,
+	}); err != nil && err != mgo.ErrNotFound {
+		panic(err)
+	}
+}
+
+// HeartbeatJob records that the worker running `j` is still alive.
+// ErrNotFound is returned if the job was meanwhile reclaimed by someone else
+// or cancelled.
+func HeartbeatJob(j *Job) error {
+	j.Heartbeat = time.Now()
+	c := mongo.DB("lxchecker").C("jobs")
+	if err := c.Update(bson.M{
+		"id":        j.Id,
+		"status":    JobRunning,
+		"worker_id": j.WorkerId,
+	}, bson.M{
+		"$set": bson.M{"heartbeat": j.Heartbeat},
+	}); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		panic(err)
+	}
+	return nil
+}
+
+// RemoveJob removes finished job `j`, provided it still belongs to its
+// worker. ErrNotFound is returned if it was meanwhile reclaimed by someone
+// else.
+func RemoveJob(j *Job) error {
+	c := mongo.DB("lxchecker").C("jobs")
+	if err := c.Remove(bson.M{
+		"id":        j.Id,
+		"status":    bson.M{"$in": []string{JobRunning, JobCancelled}},
+		"worker_id": j.WorkerId,
+	}); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		panic(err)
+	}
+	jobRemoved(j)
+	return nil
+}
+
+// CancelJob cancels the job of the given submission. Queued jobs are removed
+// right away, while running ones are marked as cancelled for their worker to
+// stop them. The job is returned as it was before being cancelled.
+// ErrNotFound is returned if the submission has no queued or running job.
+func CancelJob(subjectId, assignmentId, submissionId string) (*Job, error) {
+	job := Job{}
+	c := mongo.DB("lxchecker").C("jobs")
+	query := bson.M{
+		"subject_id":    subjectId,
+		"assignment_id": assignmentId,
+		"submission_id": submissionId,
+	}
+
+	query["status"] = JobQueued
+	if _, err := c.Find(query).Apply(mgo.Change{Remove: true}, &job); err == nil {
+		jobRemoved(&job)
+		return &job, nil
+	} else if err != mgo.ErrNotFound {
+		panic(err)
+	}
+
+	query["status"] = JobRunning
+	if _, err := c.Find(query).Apply(mgo.Change{
+		Update: bson.M{"$set": bson.M{"status": JobCancelled}},
+	}, &job); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		panic(err)
+	}
+	return &job, nil
+}
+
+// RemoveCancelledJob removes `j` if it was cancelled while running on behalf
+// of its worker.
+func RemoveCancelledJob(j *Job) error {
+	c := mongo.DB("lxchecker").C("jobs")
+	if err := c.Remove(bson.M{
+		"id":        j.Id,
+		"status":    JobCancelled,
+		"worker_id": j.WorkerId,
+	}); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		panic(err)
+	}
+	jobRemoved(j)
+	return nil
+}
+
+// RequeueJobs puts back in the queue all running jobs whose last heartbeat is
+// older than `deadline`, and forgets cancelled ones, releasing their slots.
+// It returns the number of requeued jobs.
+func RequeueJobs(deadline time.Time) int {
+	c := mongo.DB("lxchecker").C("jobs")
+	stale := []Job{}
+	if err := c.Find(bson.M{
+		"status":    bson.M{"$in": []string{JobRunning, JobCancelled}},
+		"heartbeat": bson.M{"$lt": deadline},
+	}).All(&stale); err != nil {
+		panic(err)
+	}
+	requeued := 0
+	for i := range stale {
+		j := &stale[i]
+		// Unless it was meanwhile finished, reclaimed or kept alive.
+		query := bson.M{
+			"id":        j.Id,
+			"status":    j.Status,
+			"worker_id": j.WorkerId,
+			"heartbeat": bson.M{"$lt": deadline},
+		}
+		var err error
+		if j.Status == JobCancelled {
+			err = c.Remove(query)
+		} else {
+			err = c.Update(query, bson.M{
+				"$set": bson.M{
+					"status":    JobQueued,
+					"worker_id": "",
+				},
+			})
+		}
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			panic(err)
+		}
+		if j.Status == JobCancelled {
+			jobRemoved(j)
+		} else {
+			releaseSlots(j.Id)
+			requeued++
+		}
+	}
+	pruneSlots()
+	return requeued
+}
+
+// GetSubmissionsWithoutJob returns the queued submissions uploaded before
+// `deadline` that have no job, e.g. because the server stopped right after
+// saving them. Only their ids and owner are filled in.
+func GetSubmissionsWithoutJob(deadline time.Time) []Submission {
+	submissionIds := []string{}
+	if err := mongo.DB("lxchecker").C("jobs").Find(nil).Distinct("submission_id", &submissionIds); err != nil {
+		panic(err)
+	}
+	submissions := []Submission{}
+	if err := mongo.DB("lxchecker").C("submissions").Find(bson.M{
+		"status":    StatusQueued,
+		"id":        bson.M{"$nin": submissionIds},
+		"timestamp": bson.M{"$lt": deadline},
+	}).Select(bson.M{
+		"id":             1,
+		"subject_id":     1,
+		"assignment_id":  1,
+		"owner_username": 1,
+	}).All(&submissions); err != nil {
+		panic(err)
+	}
+	return submissions
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestQueuedJobsMatch(t *testing.T) {
+	tests := []struct {
+		desc                       string
+		fullUsers, fullAssignments []jobSlots
+		want                       bson.M
+	}{
+		{
+			desc: "no full slots",
+			want: bson.M{"status": JobQueued},
+		},
+		{
+			desc:      "full users",
+			fullUsers: []jobSlots{{Username: "alice"}, {Username: "bob"}},
+			want: bson.M{
+				"status":         JobQueued,
+				"owner_username": bson.M{"$nin": []string{"alice", "bob"}},
+			},
+		},
+		{
+			desc:            "full assignments",
+			fullAssignments: []jobSlots{{SubjectId: "so", AssignmentId: "tema3"}},
+			want: bson.M{
+				"status": JobQueued,
+				"$nor":   []bson.M{{"subject_id": "so", "assignment_id": "tema3"}},
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := queuedJobsMatch(test.fullUsers, test.fullAssignments); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestBestPriorityJobs(t *testing.T) {
+	tests := []struct {
+		priorities []int
+		want       []int // indices of the jobs returned
+	}{
+		{nil, nil},
+		{[]int{JobPriorityBulk}, []int{0}},
+		{[]int{JobPriorityBulk, JobPriorityInteractive, JobPriorityBulk, JobPriorityInteractive}, []int{1, 3}},
+		{[]int{JobPriorityInteractive, JobPriorityBulk, JobPriorityInteractive}, []int{0, 2}},
+	}
+	for _, test := range tests {
+		jobs := []Job{}
+		for _, priority := range test.priorities {
+			jobs = append(jobs, Job{Priority: priority})
+		}
+		got := []int{}
+		for _, j := range bestPriorityJobs(jobs) {
+			for i := range jobs {
+				if j == &jobs[i] {
+					got = append(got, i)
+				}
+			}
+		}
+		if len(got) != len(test.want) || len(got) > 0 && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("bestPriorityJobs(%v) = jobs %v, want %v", test.priorities, got, test.want)
+		}
+	}
+}
+
+func TestNextJob(t *testing.T) {
+	now := time.Now()
+	alice := &Job{Id: "1", OwnerUsername: "alice", Timestamp: now.Add(-time.Hour)}
+	bob := &Job{Id: "2", OwnerUsername: "bob", Timestamp: now.Add(-time.Minute)}
+	carol := &Job{Id: "3", OwnerUsername: "carol", Timestamp: now}
+	tests := []struct {
+		desc       string
+		candidates []*Job
+		lastClaims map[string]time.Time
+		want       *Job
+	}{
+		{
+			desc:       "nobody served, oldest job first",
+			candidates: []*Job{bob, alice, carol},
+			lastClaims: map[string]time.Time{},
+			want:       alice,
+		},
+		{
+			desc:       "served least recently first",
+			candidates: []*Job{alice, bob, carol},
+			lastClaims: map[string]time.Time{"alice": now, "bob": now.Add(-time.Second), "carol": now},
+			want:       bob,
+		},
+		{
+			desc:       "never served before served",
+			candidates: []*Job{alice, bob, carol},
+			lastClaims: map[string]time.Time{"alice": now, "bob": now},
+			want:       carol,
+		},
+		{
+			desc:       "single candidate",
+			candidates: []*Job{carol},
+			lastClaims: map[string]time.Time{"carol": now},
+			want:       carol,
+		},
+	}
+	for _, test := range tests {
+		if got := nextJob(test.candidates, test.lastClaims); got != test.want {
+			t.Errorf("%v: got job of %v, want %v", test.desc, got.OwnerUsername, test.want.OwnerUsername)
+		}
+	}
+}
+
+func TestSlotQuery(t *testing.T) {
+	j := &Job{Id: "1", OwnerUsername: "alice", SubjectId: "so", AssignmentId: "tema3"}
+	tests := []struct {
+		desc  string
+		slots jobSlots
+		limit int
+		want  bson.M
+	}{
+		{
+			desc:  "user at most 2",
+			slots: userSlots(j),
+			limit: 2,
+			want:  bson.M{"key": "user:alice", "username": "alice", "jobs.1": bson.M{"$exists": false}},
+		},
+		{
+			desc:  "user without a limit",
+			slots: userSlots(j),
+			want:  bson.M{"key": "user:alice", "username": "alice"},
+		},
+		{
+			desc:  "assignment at most 10",
+			slots: assignmentSlots(j),
+			limit: 10,
+			want: bson.M{
+				"key":           "assignment:so/tema3",
+				"subject_id":    "so",
+				"assignment_id": "tema3",
+				"jobs.9":        bson.M{"$exists": false},
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := slotQuery(test.slots, test.limit); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Regrade is a batch of submissions of an assignment run again by a teacher,
+// e.g. after fixing the checker image.
+type Regrade struct {
+	Id           string
+	SubjectId    string `bson:"subject_id"`
+	AssignmentId string `bson:"assignment_id"`
+
+	RequestedBy    string `bson:"requested_by"`
+	Timestamp      time.Time
+	AllSubmissions bool     `bson:"all_submissions"` // otherwise only active ones
+	SubmissionIds  []string `bson:"submission_ids"`
+}
+
+func NewRegradeId() string {
+	return bson.NewObjectId().Hex()
+}
+
+func GetRegrade(subjectId, assignmentId, id string) (*Regrade, error) {
+	regrade := Regrade{}
+	c := mongo.DB("lxchecker").C("regrades")
+	if err := c.Find(bson.M{
+		"subject_id":    subjectId,
+		"assignment_id": assignmentId,
+		"id":            id,
+	}).One(&regrade); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		panic(err)
+	}
+	return &regrade, nil
+}
+
+func GetRegrades(subjectId, assignmentId string) []Regrade {
+	regrades := []Regrade{}
+	c := mongo.DB("lxchecker").C("regrades")
+	if err := c.Find(bson.M{
+		"subject_id":    subjectId,
+		"assignment_id": assignmentId,
+	}).Sort("-timestamp").All(&regrades); err != nil {
+		panic(err)
+	}
+	return regrades
+}
+
+func InsertRegrade(r *Regrade) error {
+	c := mongo.DB("lxchecker").C("regrades")
+	if err := c.Insert(r); err != nil {
+		if mgo.IsDup(err) {
+			return ErrAlreadyExists
+		}
+		panic(err)
+	}
+	return nil
+}
+
+// GetRegradedSubmissions returns the submissions with `ids`, with only what
+// is needed to compare their scores before and after regrades.
+func GetRegradedSubmissions(subjectId, assignmentId string, ids []string) []Submission {
+	submissions := []Submission{}
+	c := mongo.DB("lxchecker").C("submissions")
+	if err := c.Find(bson.M{
+		"subject_id":    subjectId,
+		"assignment_id": assignmentId,
+		"id":            bson.M{"$in": ids},
+	}).Select(bson.M{
+		"id":                     1,
+		"subject_id":             1,
+		"assignment_id":          1,
+		"owner_username":         1,
+		"status":                 1,
+		"score_by_tests":         1,
+		"history.regrade_id":     1,
+		"history.status":         1,
+		"history.score_by_tests": 1,
+	}).All(&submissions); err != nil {
+		panic(err)
+	}
+	return submissions
+}
+
+// ResetSubmissionForRegrade archives the result of `s` in its history, tagged
+// with `regradeId`, and queues it again. The result stays in effect until the
+// new run finishes. Submissions still queued or running are left alone and
+// ErrNotFound is returned for them.
+func ResetSubmissionForRegrade(s *Submission, regradeId string) error {
+	if !s.Status.IsFinished() {
+		return ErrNotFound
+	}
+	past := s.Result()
+	past.LogsFileId = archiveLog(s, "logs", s.Logs, s.LogsFileId)
+	past.StdoutFileId = archiveLog(s, "stdout", s.Stdout, s.StdoutFileId)
+	past.StderrFileId = archiveLog(s, "stderr", s.Stderr, s.StderrFileId)
+	past.RegradeId = regradeId
+	past.ArchivedAt = time.Now()
+	s.History = append(s.History, past)
+	s.Transitions = nil
+	return updateStatus(s, StatusQueued, "regrade "+regradeId, bson.M{
+		"history": s.History,
+	})
+}
+
+// archiveLog returns the id of the file holding log `name` of `s`, storing
+// `data` kept inside the document in a file if there's none.
+func archiveLog(s *Submission, name string, data []byte, fileId string) string {
+	if fileId != "" || len(data) == 0 {
+		return fileId
+	}
+	return InsertFile(fmt.Sprintf("%v-%v.log", s.Id, name), data)
+}
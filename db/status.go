@@ -0,0 +1,89 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+// Status is the state of a submission.
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusDone      Status = "done"
+	StatusTimedOut  Status = "timeout"
+	StatusOOMKilled Status = "oom_killed"
+	// The checker misbehaved, e.g. it didn't report a score.
+	StatusCheckerError Status = "checker_error"
+	// The submission couldn't be run, e.g. the image failed to pull.
+	StatusInfraError Status = "infrastructure_error"
+	StatusCancelled  Status = "cancelled"
+
+	// StatusSkipped is only used for stages not run because an earlier
+	// one failed.
+	StatusSkipped Status = "skipped"
+)
+
+// ErrBadTransition is returned when moving a submission to a status it can't
+// reach from its current one.
+var ErrBadTransition = errors.New("invalid status transition")
+
+// transitions lists the statuses each status can move to. Finished
+// submissions go back to queued when regraded, running ones when the worker
+// running them is lost. Queued submissions fail without running when their
+// job was tried too many times.
+var transitions = map[Status][]Status{
+	StatusQueued: {StatusRunning, StatusCancelled, StatusInfraError},
+	StatusRunning: {StatusQueued, StatusDone, StatusTimedOut, StatusOOMKilled,
+		StatusCheckerError, StatusInfraError, StatusCancelled},
+	StatusDone:         {StatusQueued},
+	StatusTimedOut:     {StatusQueued},
+	StatusOOMKilled:    {StatusQueued},
+	StatusCheckerError: {StatusQueued},
+	StatusInfraError:   {StatusQueued},
+	StatusCancelled:    {StatusQueued},
+}
+
+// CanTransition checks whether a submission can move from status `from` to
+// status `to`.
+func CanTransition(from, to Status) bool {
+	for _, status := range transitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFinished checks whether a submission with this status is done running.
+func (status Status) IsFinished() bool {
+	return status != StatusQueued && status != StatusRunning
+}
+
+// IsFailure checks whether the status means the submission couldn't be
+// graded.
+func (status Status) IsFailure() bool {
+	return status.IsFinished() && status != StatusDone && status != StatusCancelled
+}
+
+// Transition records a submission entering a status.
+type Transition struct {
+	Status    Status
+	Timestamp time.Time
+	Reason    string `bson:",omitempty"`
+}
+
+// setStatus moves `s` to `status` in memory, recording the transition.
+func (s *Submission) setStatus(status Status, reason string) error {
+	if !CanTransition(s.Status, status) {
+		return ErrBadTransition
+	}
+	s.Status = status
+	s.FailureReason = ""
+	if status.IsFailure() {
+		s.FailureReason = reason
+	}
+	s.Transitions = append(s.Transitions, Transition{status, time.Now(), reason})
+	return nil
+}
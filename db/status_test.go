@@ -0,0 +1,105 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to Status
+		want     bool
+	}{
+		{StatusQueued, StatusRunning, true},
+		{StatusQueued, StatusCancelled, true},
+		{StatusQueued, StatusInfraError, true},
+		{StatusQueued, StatusDone, false},
+		{StatusQueued, StatusQueued, false},
+		{StatusRunning, StatusQueued, true},
+		{StatusRunning, StatusDone, true},
+		{StatusRunning, StatusTimedOut, true},
+		{StatusRunning, StatusOOMKilled, true},
+		{StatusRunning, StatusCheckerError, true},
+		{StatusRunning, StatusInfraError, true},
+		{StatusRunning, StatusCancelled, true},
+		{StatusRunning, StatusSkipped, false},
+		{StatusDone, StatusQueued, true},
+		{StatusDone, StatusRunning, false},
+		{StatusDone, StatusCancelled, false},
+		{StatusInfraError, StatusQueued, true},
+		{StatusCancelled, StatusQueued, true},
+		{StatusCancelled, StatusRunning, false},
+		{StatusSkipped, StatusQueued, false},
+		{"pending", StatusRunning, false},
+	}
+	for _, test := range tests {
+		if got := CanTransition(test.from, test.to); got != test.want {
+			t.Errorf("CanTransition(%q, %q) = %v, want %v", test.from, test.to, got, test.want)
+		}
+	}
+}
+
+func TestStatusKind(t *testing.T) {
+	tests := []struct {
+		status   Status
+		finished bool
+		failure  bool
+	}{
+		{StatusQueued, false, false},
+		{StatusRunning, false, false},
+		{StatusDone, true, false},
+		{StatusTimedOut, true, true},
+		{StatusOOMKilled, true, true},
+		{StatusCheckerError, true, true},
+		{StatusInfraError, true, true},
+		{StatusCancelled, true, false},
+	}
+	for _, test := range tests {
+		if got := test.status.IsFinished(); got != test.finished {
+			t.Errorf("%q.IsFinished() = %v, want %v", test.status, got, test.finished)
+		}
+		if got := test.status.IsFailure(); got != test.failure {
+			t.Errorf("%q.IsFailure() = %v, want %v", test.status, got, test.failure)
+		}
+	}
+}
+
+func TestSetStatus(t *testing.T) {
+	tests := []struct {
+		from, to   Status
+		reason     string
+		wantErr    error
+		wantReason string
+	}{
+		{StatusQueued, StatusRunning, "", nil, ""},
+		{StatusRunning, StatusCheckerError, "no score", nil, "no score"},
+		{StatusRunning, StatusInfraError, "pull failed", nil, "pull failed"},
+		{StatusQueued, StatusInfraError, "run interrupted 3 times", nil, "run interrupted 3 times"},
+		// Only failures keep their reason, the others are just recorded.
+		{StatusRunning, StatusQueued, "worker lost", nil, ""},
+		{StatusDone, StatusQueued, "regrade 1", nil, ""},
+		{StatusDone, StatusRunning, "", ErrBadTransition, "old reason"},
+	}
+	for _, test := range tests {
+		s := &Submission{Status: test.from, FailureReason: "old reason"}
+		err := s.setStatus(test.to, test.reason)
+		if err != test.wantErr {
+			t.Errorf("%q -> %q: got error %v, want %v", test.from, test.to, err, test.wantErr)
+			continue
+		}
+		if s.FailureReason != test.wantReason {
+			t.Errorf("%q -> %q: failure reason %q, want %q", test.from, test.to, s.FailureReason, test.wantReason)
+		}
+		if err != nil {
+			if s.Status != test.from || len(s.Transitions) != 0 {
+				t.Errorf("%q -> %q: submission changed by a bad transition", test.from, test.to)
+			}
+			continue
+		}
+		if s.Status != test.to {
+			t.Errorf("%q -> %q: status %q", test.from, test.to, s.Status)
+		}
+		if len(s.Transitions) != 1 || s.Transitions[0].Status != test.to || s.Transitions[0].Reason != test.reason {
+			t.Errorf("%q -> %q: transitions %+v", test.from, test.to, s.Transitions)
+		}
+	}
+}
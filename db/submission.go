@@ -15,19 +15,148 @@ type Submission struct {
 
 	OwnerUsername string `bson:"owner_username"`
 
-	Status           string // TODO: make this a constant or an enum.
+	Status           Status
+	FailureReason    string `bson:"failure_reason"` // why the submission couldn't be graded
+	CancelledBy      string `bson:"cancelled_by"`
 	Timestamp        time.Time
-	UploadedFile     []byte `bson:"uploaded_file",json:"-"`
+	UploadedFile     []byte `bson:"uploaded_file",json:"-"`    // of submissions made before uploads were stored as files
+	UploadedFileId   string `bson:"uploaded_file_id",json:"-"` // of the file holding the upload, if any
 	UploadedFileName string `bson:"uploaded_file_name",json:"-"`
-	Logs             []byte
+	Logs             []byte // interleaved stdout and stderr
+	Stdout           []byte
+	Stderr           []byte
+	LogsTruncated    bool `bson:"logs_truncated"` // the log cap was exceeded
 	Metadata         map[string]string
+	Tests            []TestResult
+	Artifacts        []Artifact
+	Stages           []StageResult
+	ImageDigest      string `bson:"image_digest"` // exact checker image used
+
+	// Logs too large for the document are stored as files, only their
+	// beginning being kept above.
+	LogsFileId   string `bson:"logs_file_id"`
+	StdoutFileId string `bson:"stdout_file_id"`
+	StderrFileId string `bson:"stderr_file_id"`
 
 	ScoreByTests int `bson:"score_by_tests"`
 
+	// Resources used by the run, summed over the stages.
+	Metrics Metrics
+
+	// Results of previous runs, oldest first, kept when regrading.
+	History []PastResult
+
 	GradedByTeacher bool   `bson:"graded_by_teacher"`
 	GraderUsername  string `bson:"grader_username"`
 	ScoreByTeacher  int    `bson:"score_by_teacher"`
 	Feedback        string
+
+	// Statuses the submission went through since it was last queued,
+	// oldest first.
+	Transitions []Transition
+
+	// Version is incremented whenever the logs, stages or status change, so
+	// that the submission can be followed without fetching it all the time.
+	Version int
+
+	// LogsRun changes whenever the logs start over, i.e. for each run and
+	// each retry of a stage, so that followers know to drop what they have.
+	LogsRun int `bson:"logs_run"`
+}
+
+// PastResult is the result of a previous run of a submission.
+type PastResult struct {
+	RegradeId     string    `bson:"regrade_id"` // the regrade that replaced it
+	ArchivedAt    time.Time `bson:"archived_at"`
+	Status        Status
+	FailureReason string `bson:"failure_reason"`
+	ScoreByTests  int    `bson:"score_by_tests"`
+	ImageDigest   string `bson:"image_digest"`
+	Metadata      map[string]string
+	Tests         []TestResult
+	Metrics       Metrics
+
+	// The output and artifacts of the run, whose files are kept. Unlike
+	// the latest run's, all the logs are in files, so that the history
+	// doesn't outgrow the document.
+	LogsTruncated bool   `bson:"logs_truncated"`
+	LogsFileId    string `bson:"logs_file_id"`
+	StdoutFileId  string `bson:"stdout_file_id"`
+	StderrFileId  string `bson:"stderr_file_id"`
+	Artifacts     []Artifact
+}
+
+// Result returns the result of the latest run of `s`, as it would be kept in
+// its history, except for the logs kept inside the document.
+func (s *Submission) Result() PastResult {
+	return PastResult{
+		Status:        s.Status,
+		FailureReason: s.FailureReason,
+		ScoreByTests:  s.ScoreByTests,
+		ImageDigest:   s.ImageDigest,
+		Metadata:      s.Metadata,
+		Tests:         s.Tests,
+		Metrics:       s.Metrics,
+		LogsTruncated: s.LogsTruncated,
+		LogsFileId:    s.LogsFileId,
+		StdoutFileId:  s.StdoutFileId,
+		StderrFileId:  s.StderrFileId,
+		Artifacts:     s.Artifacts,
+	}
+}
+
+// PreviousResult returns the result a regrade is running `s` again to
+// replace, which stays in effect until the new run finishes, or nil if `s`
+// isn't being regraded.
+func (s *Submission) PreviousResult() *PastResult {
+	if s.Status.IsFinished() || len(s.History) == 0 {
+		return nil
+	}
+	return &s.History[len(s.History)-1]
+}
+
+// Metrics describes the resources used by a run.
+type Metrics struct {
+	WallTime   time.Duration `bson:"wall_time"`
+	CPUTime    time.Duration `bson:"cpu_time"`
+	PeakMemory int64         `bson:"peak_memory"` // in bytes
+	OOMKilled  bool          `bson:"oom_killed"`  // killed for exceeding the memory limit
+}
+
+// TestResult is the outcome of a single test, as reported by the checker in
+// its results file.
+type TestResult struct {
+	Name      string
+	Status    string // "passed", "failed", "skipped" or "error"
+	Points    int
+	MaxPoints int `bson:"max_points"`
+	Message   string
+	Duration  time.Duration
+}
+
+// StageResult is the outcome of a stage of the assignment's grading
+// pipeline.
+type StageResult struct {
+	Name        string
+	Status      Status // StatusQueued until it runs, or StatusSkipped
+	Logs        []byte
+	Metadata    map[string]string
+	Tests       []TestResult
+	Score       int    // as reported by the checker
+	Points      int    // score multiplied by the stage's weight
+	ImageDigest string `bson:"image_digest"`
+	Error       string
+	Metrics     Metrics
+}
+
+// Artifact is a file or directory collected from the grading container. Its
+// contents are stored as a file, directories as tar archives.
+type Artifact struct {
+	Path      string
+	FileId    string `bson:"file_id"`
+	Size      int
+	IsArchive bool `bson:"is_archive"`
+	Public    bool
 }
 
 func GetSubmission(subjectId, assignmentId, id string) (*Submission, error) {
@@ -46,6 +175,52 @@ func GetSubmission(subjectId, assignmentId, id string) (*Submission, error) {
 	return &submission, nil
 }
 
+// GetSubmissionVersion returns the version of a submission, which changes
+// along with its logs, stages or status.
+func GetSubmissionVersion(subjectId, assignmentId, id string) (int, error) {
+	submission := Submission{}
+	c := mongo.DB("lxchecker").C("submissions")
+	if err := c.Find(bson.M{
+		"subject_id":    subjectId,
+		"assignment_id": assignmentId,
+		"id":            id,
+	}).Select(bson.M{"version": 1}).One(&submission); err != nil {
+		if err == mgo.ErrNotFound {
+			return 0, ErrNotFound
+		}
+		panic(err)
+	}
+	return submission.Version, nil
+}
+
+// GetSubmissionProgress returns a submission with only what shows the
+// progress of its run filled in: its status, logs (and their run), the
+// statuses of its stages and its version.
+func GetSubmissionProgress(subjectId, assignmentId, id string) (*Submission, error) {
+	submission := Submission{}
+	c := mongo.DB("lxchecker").C("submissions")
+	if err := c.Find(bson.M{
+		"subject_id":    subjectId,
+		"assignment_id": assignmentId,
+		"id":            id,
+	}).Select(bson.M{
+		"id":            1,
+		"subject_id":    1,
+		"assignment_id": 1,
+		"status":        1,
+		"logs":          1,
+		"logs_run":      1,
+		"stages.status": 1,
+		"version":       1,
+	}).One(&submission); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrNotFound
+		}
+		panic(err)
+	}
+	return &submission, nil
+}
+
 func GetSubmissionOrPanic(subjectId, assignmentId, id string) *Submission {
 	submission, err := GetSubmission(subjectId, assignmentId, id)
 	if err != nil {
@@ -125,6 +300,7 @@ func NewSubmissionId() string {
 	return bson.NewObjectId().Hex()
 }
 
+// InsertSubmission inserts `s`, queued.
 func InsertSubmission(s *Submission) error {
 	if _, err := GetAssignment(s.SubjectId, s.AssignmentId); err != nil {
 		if err == ErrNotFound {
@@ -138,6 +314,9 @@ func InsertSubmission(s *Submission) error {
 		}
 		panic(err)
 	}
+	s.Status = StatusQueued
+	s.FailureReason = ""
+	s.Transitions = []Transition{{Status: StatusQueued, Timestamp: time.Now()}}
 	c := mongo.DB("lxchecker").C("submissions")
 	if err := c.Insert(s); err != nil {
 		if mgo.IsDup(err) {
@@ -162,3 +341,203 @@ func UpdateSubmission(s *Submission) error {
 	}
 	return nil
 }
+
+// UpdateSubmissionLogs only updates the logs of a submission, leaving
+// other fields (e.g. the teacher's grade) untouched.
+func UpdateSubmissionLogs(s *Submission) error {
+	c := mongo.DB("lxchecker").C("submissions")
+	if err := c.Update(bson.M{
+		"subject_id":    s.SubjectId,
+		"assignment_id": s.AssignmentId,
+		"id":            s.Id,
+	}, bson.M{
+		"$set": bson.M{"logs": s.Logs, "logs_run": s.LogsRun},
+		"$inc": bson.M{"version": 1},
+	}); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		panic(err)
+	}
+	return nil
+}
+
+// UpdateSubmissionStages only updates the stages of a submission, so that
+// the progress of its pipeline can be followed.
+func UpdateSubmissionStages(s *Submission) error {
+	c := mongo.DB("lxchecker").C("submissions")
+	if err := c.Update(bson.M{
+		"subject_id":    s.SubjectId,
+		"assignment_id": s.AssignmentId,
+		"id":            s.Id,
+	}, bson.M{
+		"$set": bson.M{"stages": s.Stages},
+		"$inc": bson.M{"version": 1},
+	}); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		panic(err)
+	}
+	return nil
+}
+
+// GradeSubmission only updates the teacher's grade of a submission, so that
+// grading doesn't race with the submission being run.
+func GradeSubmission(s *Submission) error {
+	c := mongo.DB("lxchecker").C("submissions")
+	if err := c.Update(bson.M{
+		"subject_id":    s.SubjectId,
+		"assignment_id": s.AssignmentId,
+		"id":            s.Id,
+	}, bson.M{
+		"$set": bson.M{
+			"graded_by_teacher": s.GradedByTeacher,
+			"grader_username":   s.GraderUsername,
+			"score_by_teacher":  s.ScoreByTeacher,
+			"feedback":          s.Feedback,
+		},
+	}); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		panic(err)
+	}
+	return nil
+}
+
+// updateStatus moves `s` to `status`, provided its status wasn't changed
+// meanwhile, and saves the given `fields` of `s` along with it. Other fields
+// (e.g. the teacher's grade) are left untouched. ErrNotFound is returned if
+// the status was changed.
+func updateStatus(s *Submission, status Status, reason string, fields bson.M) error {
+	from := s.Status
+	if err := s.setStatus(status, reason); err != nil {
+		return err
+	}
+	set := bson.M{
+		"status":         s.Status,
+		"failure_reason": s.FailureReason,
+		"transitions":    s.Transitions,
+	}
+	for key, value := range fields {
+		set[key] = value
+	}
+	c := mongo.DB("lxchecker").C("submissions")
+	if err := c.Update(bson.M{
+		"subject_id":    s.SubjectId,
+		"assignment_id": s.AssignmentId,
+		"id":            s.Id,
+		"status":        from,
+	}, bson.M{
+		"$set": set,
+		"$inc": bson.M{"version": 1},
+	}); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotFound
+		}
+		panic(err)
+	}
+	return nil
+}
+
+// resultFields returns the fields of `s` holding the result of its run.
+func resultFields(s *Submission) bson.M {
+	return bson.M{
+		"logs":           s.Logs,
+		"logs_run":       s.LogsRun,
+		"stdout":         s.Stdout,
+		"stderr":         s.Stderr,
+		"logs_truncated": s.LogsTruncated,
+		"logs_file_id":   s.LogsFileId,
+		"stdout_file_id": s.StdoutFileId,
+		"stderr_file_id": s.StderrFileId,
+		"metadata":       s.Metadata,
+		"tests":          s.Tests,
+		"artifacts":      s.Artifacts,
+		"stages":         s.Stages,
+		"image_digest":   s.ImageDigest,
+		"score_by_tests": s.ScoreByTests,
+		"metrics":        s.Metrics,
+	}
+}
+
+// StartSubmission marks queued submission `s` as running. ErrNotFound is
+// returned if it is no longer queued (e.g. it was cancelled meanwhile).
+func StartSubmission(s *Submission) error {
+	if s.Status != StatusQueued {
+		return ErrNotFound
+	}
+	return updateStatus(s, StatusRunning, "", nil)
+}
+
+// GiveUpSubmission fails queued submission `s` with an infrastructure error
+// without running it, keeping the result of its previous run (if any).
+// ErrNotFound is returned if it is no longer queued.
+func GiveUpSubmission(s *Submission, reason string) error {
+	if s.Status != StatusQueued {
+		return ErrNotFound
+	}
+	return updateStatus(s, StatusInfraError, reason, nil)
+}
+
+// RequeueSubmission puts running submission `s` back in the queue, e.g. after
+// its worker was lost.
+func RequeueSubmission(s *Submission, reason string) error {
+	return updateStatus(s, StatusQueued, reason, nil)
+}
+
+// FinishSubmission updates `s` with the outcome of its run, moving it to the
+// finished `status`, unless it is no longer running (e.g. it was cancelled
+// meanwhile). ErrNotFound is returned in that case.
+func FinishSubmission(s *Submission, status Status, reason string) error {
+	if s.Status != StatusRunning {
+		return ErrNotFound
+	}
+	return updateStatus(s, status, reason, resultFields(s))
+}
+
+// CancelSubmission marks `s` as cancelled by `username`, provided it is still
+// queued or running. ErrNotFound is returned otherwise.
+func CancelSubmission(s *Submission, username string) error {
+	for {
+		if s.Status.IsFinished() {
+			return ErrNotFound
+		}
+		from := s.Status
+		c := mongo.DB("lxchecker").C("submissions")
+		err := c.Update(bson.M{
+			"subject_id":    s.SubjectId,
+			"assignment_id": s.AssignmentId,
+			"id":            s.Id,
+			"status":        from,
+		}, bson.M{
+			"$set": bson.M{"status": StatusCancelled, "failure_reason": "", "cancelled_by": username},
+			"$inc": bson.M{"version": 1},
+			"$push": bson.M{"transitions": Transition{
+				Status:    StatusCancelled,
+				Timestamp: time.Now(),
+				Reason:    "cancelled by " + username,
+			}},
+		})
+		if err == nil {
+			break
+		}
+		if err != mgo.ErrNotFound {
+			panic(err)
+		}
+		// the submission may have started running meanwhile
+		fresh, err := GetSubmission(s.SubjectId, s.AssignmentId, s.Id)
+		if err != nil {
+			return err
+		}
+		if fresh.Status == from {
+			return ErrNotFound
+		}
+		*s = *fresh
+	}
+	s.Status = StatusCancelled
+	s.FailureReason = ""
+	s.CancelledBy = username
+	return nil
+}
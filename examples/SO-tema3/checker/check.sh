@@ -1,8 +1,12 @@
 #!/bin/bash
 
+# The checker runs as nobody on a read-only root filesystem, where only the
+# submission's directory and /tmp are writable, so the tests are built and
+# run in a copy of the checker.
 cd /submission
 unzip submission.zip
 make
-cp /submission/libvmsim.so /checker
-cd /checker
+cp -r /checker /tmp/checker
+cp /submission/libvmsim.so /tmp/checker
+cd /tmp/checker
 make -f Makefile.checker
@@ -1,10 +1,27 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
+	"github.com/AndreiDuma/lxchecker/cli"
 	"github.com/AndreiDuma/lxchecker/web"
 )
 
 func main() {
+	// Run a subcommand if given one.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "grade":
+			os.Exit(cli.Grade(os.Args[2:]))
+		case "try":
+			os.Exit(cli.Try(os.Args[2:]))
+		default:
+			fmt.Fprintf(os.Stderr, "usage: lxchecker [grade|try]\n")
+			os.Exit(2)
+		}
+	}
+
 	// Start the web server.
 	web.Start()
 }
@@ -0,0 +1,53 @@
+package scheduler
+
+import (
+	"errors"
+	"io"
+
+	"golang.org/x/net/context"
+)
+
+// Builder is implemented by executors able to build images.
+type Builder interface {
+	// Build builds an image from `buildContext`, a tar archive (possibly
+	// gzipped) holding a Dockerfile at its root, tags it `tag` and
+	// returns its digest. The build output is written to `output`.
+	Build(ctx context.Context, buildContext []byte, tag string, output io.Writer) (string, error)
+}
+
+// BuiltImage is an image built with Scheduler.Build and still in use, which
+// hosts that missed its build have to build again.
+type BuiltImage struct {
+	Tag string
+	// Context returns the build context the image was built from.
+	Context func() ([]byte, error)
+}
+
+// imageKeeper is implemented by executors spreading images over several
+// hosts, which some of them may miss.
+type imageKeeper interface {
+	SetBuiltImages(images func() []BuiltImage)
+}
+
+// ErrBuildUnsupported is returned by Scheduler.Build if the executor can't
+// build images.
+var ErrBuildUnsupported = errors.New("Executor can't build images")
+
+// Build builds an image from `buildContext` and tags it `tag`, writing the
+// build output to `output`. It returns the digest of the image, which is
+// then available to submissions.
+func (scheduler *Scheduler) Build(ctx context.Context, buildContext []byte, tag string, output io.Writer) (string, error) {
+	builder, ok := scheduler.executor.(Builder)
+	if !ok {
+		return "", ErrBuildUnsupported
+	}
+	return builder.Build(ctx, buildContext, tag, output)
+}
+
+// SetBuiltImages tells the executor which built images are in use, so that it
+// can build them on hosts missing them, if it has several.
+func (scheduler *Scheduler) SetBuiltImages(images func() []BuiltImage) {
+	if keeper, ok := scheduler.executor.(imageKeeper); ok {
+		keeper.SetBuiltImages(images)
+	}
+}
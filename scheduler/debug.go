@@ -0,0 +1,51 @@
+package scheduler
+
+import (
+	"errors"
+	"io"
+
+	"golang.org/x/net/context"
+)
+
+// TerminalSize is the size of a terminal, in characters.
+type TerminalSize struct {
+	Cols int
+	Rows int
+}
+
+// DebugSession connects an interactive shell to a terminal.
+type DebugSession struct {
+	// Input carries the keystrokes typed in the terminal.
+	Input io.Reader
+	// Output receives what the shell writes to the terminal.
+	Output io.Writer
+	// Resize receives the new size of the terminal whenever it changes.
+	Resize <-chan TerminalSize
+}
+
+// Debugger is implemented by executors able to open a shell into the
+// environment a submission is graded in.
+type Debugger interface {
+	// Debug sets up the environment of a run from `options`, without
+	// running the checker, and attaches an interactive shell inside it to
+	// `session`. It returns once the shell exits or `ctx` is done, which
+	// must have a deadline; the environment is then destroyed.
+	Debug(ctx context.Context, options SubmitOptions, session DebugSession) error
+}
+
+// ErrDebugUnsupported is returned by Scheduler.Debug if the executor can't
+// open debug shells.
+var ErrDebugUnsupported = errors.New("Executor can't open debug shells")
+
+// errNoDeadline is returned by debuggers for sessions without a time limit.
+var errNoDeadline = errors.New("Debug sessions must have a time limit")
+
+// Debug opens an interactive shell into the environment of a run from
+// `options`, attached to `session`, until the shell exits or `ctx` is done.
+func (scheduler *Scheduler) Debug(ctx context.Context, options SubmitOptions, session DebugSession) error {
+	debugger, ok := scheduler.executor.(Debugger)
+	if !ok {
+		return ErrDebugUnsupported
+	}
+	return debugger.Debug(ctx, options, session)
+}
@@ -0,0 +1,868 @@
+package scheduler
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/docker/go-units"
+	"golang.org/x/net/context"
+)
+
+// removeTimeout bounds the time spent removing a container after a run.
+const removeTimeout = 30 * time.Second
+
+// transientMessages are found in the errors of requests to Docker, or of
+// Docker's own requests to registries, that may succeed if made again.
+// Errors returned by the daemon only carry its message, and its status if
+// the message is empty.
+var transientMessages = []string{
+	"Cannot connect to the Docker daemon",
+	"An error occurred trying to connect",
+	"error during connect",
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"no such host",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"Client.Timeout exceeded",
+	"unexpected EOF",
+	"Internal Server Error",
+	"Bad Gateway",
+	"Service Unavailable",
+	"Gateway Timeout",
+	"toomanyrequests",
+}
+
+// dockerError prefixes the message of `err`, returned by Docker, with
+// `prefix` and tells its kind. Failures to reach Docker or a registry that
+// may not happen again (an unreachable host, a timeout, a dropped connection
+// or a server error) are infrastructure errors. Anything else is Docker
+// rejecting the request as it would every time, e.g. a bad ulimit or seccomp
+// profile, and is a ConfigError. Cancellations are left alone.
+func dockerError(err error, prefix string) error {
+	wrapped := fmt.Errorf("%v: %v", prefix, err)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return wrapped
+	}
+	if _, ok := err.(net.Error); ok || client.IsErrConnectionFailed(err) || err == io.ErrUnexpectedEOF {
+		return InfraError{wrapped}
+	}
+	for _, message := range transientMessages {
+		if strings.Contains(err.Error(), message) {
+			return InfraError{wrapped}
+		}
+	}
+	return ConfigError{wrapped}
+}
+
+// DockerExecutor runs submissions in Docker containers. It connects to the
+// Docker host on first use, and again after the host turns out to be
+// unreachable, so that the host needn't be up when lxchecker starts.
+type DockerExecutor struct {
+	// newClient creates a client for the Docker host.
+	newClient func() (*client.Client, error)
+
+	mu  sync.Mutex
+	cli *client.Client
+	// stale is set once the host was found unreachable, so that the
+	// client is replaced, dropping its connections.
+	stale bool
+}
+
+// NewDockerExecutor creates an executor for the Docker host described by the
+// DOCKER_* environment variables.
+func NewDockerExecutor() *DockerExecutor {
+	return &DockerExecutor{newClient: client.NewEnvClient}
+}
+
+// NewDockerExecutorForHost creates an executor for the Docker host at
+// `address`, e.g. "tcp://10.0.0.2:2376". TLS is used if DOCKER_CERT_PATH is
+// set, as for NewDockerExecutor.
+func NewDockerExecutorForHost(address string) *DockerExecutor {
+	return &DockerExecutor{newClient: func() (*client.Client, error) {
+		var httpClient *http.Client
+		if certPath := os.Getenv("DOCKER_CERT_PATH"); certPath != "" {
+			tlsConfig, err := tlsconfig.Client(tlsconfig.Options{
+				CAFile:             filepath.Join(certPath, "ca.pem"),
+				CertFile:           filepath.Join(certPath, "cert.pem"),
+				KeyFile:            filepath.Join(certPath, "key.pem"),
+				InsecureSkipVerify: os.Getenv("DOCKER_TLS_VERIFY") == "",
+			})
+			if err != nil {
+				return nil, err
+			}
+			httpClient = &http.Client{
+				Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			}
+		}
+
+		version := os.Getenv("DOCKER_API_VERSION")
+		if version == "" {
+			version = api.DefaultVersion
+		}
+		return client.NewClient(address, version, httpClient, nil)
+	}}
+}
+
+// connect makes sure there is an up to date client for the Docker host. It
+// must succeed once before client is called.
+func (executor *DockerExecutor) connect() error {
+	executor.mu.Lock()
+	defer executor.mu.Unlock()
+	if executor.cli != nil && !executor.stale {
+		return nil
+	}
+	cli, err := executor.newClient()
+	if err != nil {
+		// keep using the old client, if any
+		return fmt.Errorf("Failed to connect to Docker: %v", err)
+	}
+	if executor.cli != nil {
+		executor.cli.Close()
+	}
+	executor.cli, executor.stale = cli, false
+	return nil
+}
+
+// client returns the current client for the Docker host.
+func (executor *DockerExecutor) client() *client.Client {
+	executor.mu.Lock()
+	defer executor.mu.Unlock()
+	return executor.cli
+}
+
+// Ping checks that the Docker host is reachable, reconnecting if it wasn't.
+func (executor *DockerExecutor) Ping(ctx context.Context) error {
+	if err := executor.connect(); err != nil {
+		return err
+	}
+	if _, err := executor.client().Ping(ctx); err != nil {
+		executor.mu.Lock()
+		executor.stale = true
+		executor.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// makeWorkDirTar creates a tar archive to be copied to the work directory
+// `dir`, relative to it. It holds the writable directories inside `dir`
+// (except the root itself) and, if they belong there, the submission, placed
+// at options.SubmissionPath as a file or, if unpacked, as a directory, and the
+// fixtures.
+func makeWorkDirTar(options SubmitOptions, dir string) (io.Reader, error) {
+	buffer := new(bytes.Buffer)
+	tw := tar.NewWriter(buffer)
+	rel := func(name string) string {
+		if name == dir {
+			return "."
+		}
+		return strings.TrimPrefix(strings.TrimPrefix(name, dir), "/")
+	}
+
+	// directories are writable, since checkers may run unprivileged and
+	// usually build the submission in place
+	dirs := map[string]bool{}
+	addDir := func(name string) error {
+		if dirs[name] || name == "/" {
+			return nil
+		}
+		dirs[name] = true
+		return tw.WriteHeader(&tar.Header{
+			Name:     rel(name) + "/",
+			Mode:     0777,
+			Typeflag: tar.TypeDir,
+		})
+	}
+	for _, writable := range writableDirs(options) {
+		if isInDir(writable, dir) {
+			if err := addDir(writable); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	root := path.Clean("/" + options.SubmissionPath)
+	switch {
+	case !isInDir(root, dir):
+	case options.SubmissionFiles == nil:
+		if err := tw.WriteHeader(&tar.Header{
+			Name: rel(root),
+			Mode: 0444,
+			Size: int64(len(options.Submission)),
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(options.Submission); err != nil {
+			return nil, err
+		}
+	default:
+		if err := addDir(root); err != nil {
+			return nil, err
+		}
+		for _, f := range options.SubmissionFiles {
+			name := path.Join(root, f.Name)
+			// add parent directories first
+			for _, parent := range parentDirs(root, name) {
+				if err := addDir(parent); err != nil {
+					return nil, err
+				}
+			}
+			if err := tw.WriteHeader(&tar.Header{
+				Name: rel(name),
+				Mode: f.Mode | 0444,
+				Size: int64(len(f.Data)),
+			}); err != nil {
+				return nil, err
+			}
+			if _, err := tw.Write(f.Data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// fixtures are read-only, so that checkers can't tamper with them
+	fixturesRoot := path.Clean("/" + options.FixturesPath)
+	if options.Fixtures != nil && isInDir(fixturesRoot, dir) {
+		addFixturesDir := func(name string) error {
+			if dirs[name] || name == "/" {
+				return nil
+			}
+			dirs[name] = true
+			return tw.WriteHeader(&tar.Header{
+				Name:     rel(name) + "/",
+				Mode:     0755,
+				Typeflag: tar.TypeDir,
+			})
+		}
+		if err := addFixturesDir(fixturesRoot); err != nil {
+			return nil, err
+		}
+		for _, f := range options.Fixtures {
+			name := path.Join(fixturesRoot, f.Name)
+			for _, parent := range parentDirs(fixturesRoot, name) {
+				if err := addFixturesDir(parent); err != nil {
+					return nil, err
+				}
+			}
+			if err := tw.WriteHeader(&tar.Header{
+				Name: rel(name),
+				Mode: (f.Mode | 0444) &^ 0222,
+				Size: int64(len(f.Data)),
+			}); err != nil {
+				return nil, err
+			}
+			if _, err := tw.Write(f.Data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// parentDirs returns the directories between `root` and `name`, outermost
+// first.
+func parentDirs(root, name string) []string {
+	dirs := []string{}
+	for dir := path.Dir(name); dir != root && strings.HasPrefix(dir, root+"/"); dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	return dirs
+}
+
+// makeHostConfig translates resource limits to Docker's host configuration.
+func makeHostConfig(r Resources) *container.HostConfig {
+	hostConfig := &container.HostConfig{}
+	if r.Memory > 0 {
+		hostConfig.Memory = r.Memory
+		// Don't allow swapping either.
+		hostConfig.MemorySwap = r.Memory
+	}
+	if r.CPUs > 0 {
+		hostConfig.CPUPeriod = cpuPeriod
+		hostConfig.CPUQuota = int64(r.CPUs * cpuPeriod)
+	}
+	if r.PidsLimit > 0 {
+		hostConfig.PidsLimit = r.PidsLimit
+	}
+	for _, u := range r.Ulimits {
+		hostConfig.Ulimits = append(hostConfig.Ulimits, &units.Ulimit{
+			Name: u.Name,
+			Soft: u.Soft,
+			Hard: u.Hard,
+		})
+	}
+	if r.TmpfsSize > 0 {
+		hostConfig.Tmpfs = map[string]string{
+			"/tmp": fmt.Sprintf("rw,exec,size=%d", r.TmpfsSize),
+		}
+	}
+	if r.DiskSize > 0 {
+		// Only honored by some storage drivers (e.g. devicemapper, or
+		// overlay2 on xfs with project quotas).
+		hostConfig.StorageOpt = map[string]string{
+			"size": fmt.Sprintf("%d", r.DiskSize),
+		}
+	}
+	return hostConfig
+}
+
+// applySecurity confines the container according to `security`, the work
+// directories `dirs` being the only writable ones besides /tmp if the root
+// filesystem is read-only.
+func applySecurity(config *container.Config, hostConfig *container.HostConfig, security Security, dirs []string) error {
+	config.User = security.user()
+	hostConfig.CapDrop = []string{"ALL"}
+	hostConfig.CapAdd = security.CapAdd
+	hostConfig.SecurityOpt = []string{"no-new-privileges"}
+	// Docker applies its default profile unless given another one
+	if security.SeccompProfile != "" {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp="+security.SeccompProfile)
+	}
+	if security.WritableRootfs {
+		return nil
+	}
+
+	hostConfig.ReadonlyRootfs = true
+	if hostConfig.Tmpfs == nil {
+		hostConfig.Tmpfs = map[string]string{
+			"/tmp": fmt.Sprintf("rw,exec,size=%d", DefaultTmpfsSize),
+		}
+	}
+	config.Volumes = map[string]struct{}{}
+	for _, dir := range dirs {
+		if dir == "/" {
+			return ConfigError{fmt.Errorf("The submission, results and artifacts must be inside directories when the root filesystem is read-only")}
+		}
+		config.Volumes[dir] = struct{}{}
+	}
+	return nil
+}
+
+// createContainer creates a container from `config` for the submission in
+// `options`, applying its limits, confinement and network and copying the
+// submission to it. Containers created with `autoRemove` are removed by
+// Docker once they stop.
+func (executor *DockerExecutor) createContainer(ctx context.Context, options SubmitOptions, config *container.Config, autoRemove bool) (string, error) {
+	hostConfig := makeHostConfig(options.Resources)
+	hostConfig.AutoRemove = autoRemove
+	dirs := workDirs(options)
+	if err := applySecurity(config, hostConfig, options.Security, dirs); err != nil {
+		return "", err
+	}
+	if options.Network == "" {
+		config.NetworkDisabled = true
+		hostConfig.NetworkMode = "none"
+	} else {
+		// only allow networks with no access to the outside world
+		network, err := executor.client().NetworkInspect(ctx, options.Network)
+		if err != nil {
+			return "", dockerError(err, "Failed to inspect network")
+		}
+		if !network.Internal {
+			return "", ConfigError{fmt.Errorf("Network %v is not internal", options.Network)}
+		}
+		hostConfig.NetworkMode = container.NetworkMode(options.Network)
+	}
+	created, err := executor.client().ContainerCreate(ctx, config, hostConfig, nil, "")
+	if err != nil {
+		return "", dockerError(err, "Failed to create container")
+	}
+
+	// copy the submission and the writable directories to the container,
+	// one work directory at a time since only volumes can be written to
+	// under a read-only root filesystem
+	for _, dir := range dirs {
+		tar, err := makeWorkDirTar(options, dir)
+		if err != nil {
+			executor.removeContainer(created.ID)
+			return "", fmt.Errorf("Couldn't tar submission: %v", err)
+		}
+		if err = executor.client().CopyToContainer(ctx, created.ID, dir, tar, types.CopyToContainerOptions{}); err != nil {
+			executor.removeContainer(created.ID)
+			return "", dockerError(err, "Failed to copy submission to container")
+		}
+	}
+	return created.ID, nil
+}
+
+// removeContainer removes a container and its anonymous volumes, killing it
+// if needed.
+func (executor *DockerExecutor) removeContainer(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), removeTimeout)
+	defer cancel()
+	removeOptions := types.ContainerRemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
+	}
+	if err := executor.client().ContainerRemove(ctx, id, removeOptions); err != nil {
+		log.Printf("Failed to remove container %v: %v\n", id, err)
+	}
+}
+
+// Run prepares a submission, creates a container for it, starts it, waits
+// for it to exit and returns the logs, also streaming them to options.Output.
+// Containers exceeding the timeout are killed. Containers are always removed
+// before returning.
+func (executor *DockerExecutor) Run(ctx context.Context, options SubmitOptions) (SubmitResponse, error) {
+	r := SubmitResponse{}
+	if err := executor.connect(); err != nil {
+		return r, err
+	}
+
+	// make sure the image is available and pin it for this run
+	image, err := executor.prepareImage(ctx, options.Image, options.PullPolicy)
+	if err != nil {
+		return r, err
+	}
+	r.ImageDigest = imageDigest(image)
+
+	// create the container, removed once done with it
+	config := &container.Config{
+		Image: image.ID,
+	}
+	if options.Command != "" {
+		config.Cmd = []string{"/bin/sh", "-c", options.Command}
+	}
+	id, err := executor.createContainer(ctx, options, config, false)
+	if err != nil {
+		return r, err
+	}
+	defer executor.removeContainer(id)
+
+	// start the container
+	if err = executor.client().ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+		return r, dockerError(err, "Failed to start container")
+	}
+
+	// follow the container's logs as they are produced
+	logsOptions := types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	}
+	logsReader, err := executor.client().ContainerLogs(ctx, id, logsOptions)
+	if err != nil {
+		return r, dockerError(err, "Couldn't get logs from container")
+	}
+	defer logsReader.Close()
+	logs := newRunLogs(options)
+	logsDone := make(chan error, 1)
+	go func() {
+		// without a TTY, both streams are multiplexed on the connection
+		_, err := stdcopy.StdCopy(logs.Stdout(), logs.Stderr(), logsReader)
+		logsDone <- err
+	}()
+
+	// sample the container's resource usage while it runs
+	ctxStats, cancelStats := context.WithCancel(ctx)
+	defer cancelStats()
+	stats := executor.watchStats(ctxStats, id)
+	started := time.Now()
+
+	// wait for the container to exit
+	ctxWait, cancel := context.WithTimeout(ctx, options.Timeout)
+	r.ExitCode, err = executor.client().ContainerWait(ctxWait, id)
+	timedOut := ctxWait.Err() == context.DeadlineExceeded && ctx.Err() == nil
+	cancel()
+	if err != nil {
+		if !timedOut {
+			return r, dockerError(err, "Wait failed")
+		}
+
+		// the container took too long, kill it but still collect its logs
+		r.TimedOut = true
+		if err = executor.client().ContainerKill(ctx, id, "KILL"); err != nil {
+			return r, dockerError(err, "Failed to kill container")
+		}
+	}
+
+	// gather the metrics of the run
+	r.Metrics.WallTime = time.Since(started)
+	cancelStats()
+	r.Metrics.CPUTime, r.Metrics.PeakMemory = stats.wait()
+	info, err := executor.client().ContainerInspect(ctx, id)
+	if err != nil {
+		return r, dockerError(err, "Failed to inspect container")
+	}
+	r.Metrics.OOMKilled = info.State.OOMKilled
+
+	// the logs end once the container has stopped
+	if err = <-logsDone; err != nil {
+		return r, dockerError(err, "Failed reading the logs")
+	}
+	logs.fill(&r)
+
+	// get the results file, if the checker wrote one
+	results, isArchive, err := executor.readPath(ctx, id, options.resultsPath(), maxResultsSize)
+	if err != nil {
+		return r, wrapError(err, "Couldn't get results from container")
+	}
+	if isArchive {
+		return r, CheckerError{fmt.Errorf("Results file %v is a directory", options.resultsPath())}
+	}
+	r.Results = results
+
+	// collect the artifacts
+	for _, path := range options.Artifacts {
+		data, isArchive, err := executor.readPath(ctx, id, path, maxArtifactSize)
+		if err != nil {
+			log.Printf("Couldn't get artifact %v from container: %v\n", path, err)
+			continue
+		}
+		if data != nil {
+			r.Artifacts = append(r.Artifacts, Artifact{path, data, isArchive})
+		}
+	}
+	return r, nil
+}
+
+// debugShell is the shell started by Debug, bash if available.
+var debugShell = []string{"/bin/sh", "-c", "if [ -x /bin/bash ]; then exec /bin/bash -i; else exec /bin/sh -i; fi"}
+
+// Debug creates a container for the submission in `options` that does
+// nothing until the deadline of `ctx`, and attaches a shell started in it,
+// running as the checker would, to `session`. The container is removed once
+// done with it, or by Docker when the deadline passes should this process
+// die meanwhile.
+func (executor *DockerExecutor) Debug(ctx context.Context, options SubmitOptions, session DebugSession) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errNoDeadline
+	}
+	if err := executor.connect(); err != nil {
+		return err
+	}
+	image, err := executor.prepareImage(ctx, options.Image, options.PullPolicy)
+	if err != nil {
+		return err
+	}
+	seconds := int(deadline.Sub(time.Now())/time.Second) + 1
+	config := &container.Config{
+		Image:      image.ID,
+		Entrypoint: []string{"sleep"},
+		Cmd:        []string{strconv.Itoa(seconds)},
+	}
+	id, err := executor.createContainer(ctx, options, config, true)
+	if err != nil {
+		return err
+	}
+	defer executor.removeContainer(id)
+	if err = executor.client().ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+		return dockerError(err, "Failed to start container")
+	}
+
+	// start the shell with a TTY, so that it behaves interactively
+	execConfig := types.ExecConfig{
+		User:         options.Security.user(),
+		Tty:          true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          debugShell,
+	}
+	exec, err := executor.client().ContainerExecCreate(ctx, id, execConfig)
+	if err != nil {
+		return dockerError(err, "Failed to create shell")
+	}
+	attach, err := executor.client().ContainerExecAttach(ctx, exec.ID, execConfig)
+	if err != nil {
+		return dockerError(err, "Failed to attach to shell")
+	}
+	defer attach.Close()
+
+	go func() {
+		io.Copy(attach.Conn, session.Input)
+		attach.CloseWrite()
+	}()
+	outputDone := make(chan struct{})
+	go func() {
+		// with a TTY, the output isn't multiplexed
+		io.Copy(session.Output, attach.Reader)
+		close(outputDone)
+	}()
+	for {
+		select {
+		case size := <-session.Resize:
+			if err := executor.client().ContainerExecResize(ctx, exec.ID, types.ResizeOptions{
+				Height: uint(size.Rows),
+				Width:  uint(size.Cols),
+			}); err != nil {
+				log.Printf("Failed to resize shell: %v\n", err)
+			}
+		case <-outputDone:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// readPath returns the contents of the file at `path` inside a container,
+// or a tar archive of it if it's a directory. nil is returned if there's no
+// such path. Contents larger than `maxSize` are rejected.
+func (executor *DockerExecutor) readPath(ctx context.Context, containerID, path string, maxSize int64) ([]byte, bool, error) {
+	stat, err := executor.client().ContainerStatPath(ctx, containerID, path)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil, false, nil
+		}
+		return nil, false, dockerError(err, "Failed to stat path in container")
+	}
+	reader, _, err := executor.client().CopyFromContainer(ctx, containerID, path)
+	if err != nil {
+		return nil, false, dockerError(err, "Failed to copy from container")
+	}
+	defer reader.Close()
+
+	// directories are kept as the tar archive we receive
+	if stat.Mode.IsDir() {
+		data, err := ioutil.ReadAll(io.LimitReader(reader, maxSize+1))
+		if err != nil {
+			return nil, false, dockerError(err, "Failed to copy from container")
+		}
+		if int64(len(data)) > maxSize {
+			return nil, false, CheckerError{fmt.Errorf("%v is larger than %d bytes", path, maxSize)}
+		}
+		return data, true, nil
+	}
+
+	// files come as the single entry of a tar archive
+	tr := tar.NewReader(reader)
+	header, err := tr.Next()
+	if err != nil {
+		return nil, false, dockerError(err, "Failed to copy from container")
+	}
+	if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+		return nil, false, CheckerError{fmt.Errorf("%v is not a regular file", path)}
+	}
+	if header.Size > maxSize {
+		return nil, false, CheckerError{fmt.Errorf("%v is larger than %d bytes", path, maxSize)}
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, false, dockerError(err, "Failed to copy from container")
+	}
+	return data, false, nil
+}
+
+// dockerStats holds the resource usage of a container, as sampled by
+// watchStats.
+type dockerStats struct {
+	mu         sync.Mutex
+	cpuTime    time.Duration
+	peakMemory int64
+
+	done chan struct{}
+}
+
+// watchStats samples the resource usage of container `id` until `ctx` is
+// cancelled. Docker reports it about once a second and not at all once the
+// container has exited, so the peak memory usage may be missed and runs
+// shorter than that may report no usage at all.
+func (executor *DockerExecutor) watchStats(ctx context.Context, id string) *dockerStats {
+	s := &dockerStats{done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		stats, err := executor.client().ContainerStats(ctx, id, true)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Couldn't get stats of container %v: %v\n", id, err)
+			}
+			return
+		}
+		defer stats.Body.Close()
+
+		decoder := json.NewDecoder(stats.Body)
+		for {
+			var sample types.StatsJSON
+			if err := decoder.Decode(&sample); err != nil {
+				return
+			}
+			s.mu.Lock()
+			if cpuTime := time.Duration(sample.CPUStats.CPUUsage.TotalUsage); cpuTime > s.cpuTime {
+				s.cpuTime = cpuTime
+			}
+			if memory := memoryUsage(sample.MemoryStats); memory > s.peakMemory {
+				s.peakMemory = memory
+			}
+			s.mu.Unlock()
+		}
+	}()
+	return s
+}
+
+// memoryUsage returns the memory used by a container, leaving out the page
+// cache that can be reclaimed, like `docker stats` does. The maximum usage
+// isn't used since it includes the page cache, and cgroup v2 lacks it.
+func memoryUsage(stats types.MemoryStats) int64 {
+	usage := stats.Usage
+	// cgroup v1 names the counter differently
+	for _, key := range []string{"inactive_file", "total_inactive_file"} {
+		if inactive, ok := stats.Stats[key]; ok {
+			if inactive < usage {
+				usage -= inactive
+			} else {
+				usage = 0
+			}
+			break
+		}
+	}
+	return int64(usage)
+}
+
+// wait waits for watchStats to stop and returns the CPU time and the peak
+// memory usage seen.
+func (s *dockerStats) wait() (time.Duration, int64) {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cpuTime, s.peakMemory
+}
+
+// Pull makes sure `image` is available according to `policy` and returns its
+// digest.
+func (executor *DockerExecutor) Pull(ctx context.Context, image string, policy PullPolicy) (string, error) {
+	if err := executor.connect(); err != nil {
+		return "", err
+	}
+	inspect, err := executor.prepareImage(ctx, image, policy)
+	if err != nil {
+		return "", err
+	}
+	return imageDigest(inspect), nil
+}
+
+// buildMessage is a line of the JSON stream returned by Docker while
+// building or pulling an image.
+type buildMessage struct {
+	Stream string `json:"stream"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// Build builds an image from `buildContext` and tags it `tag`, writing the
+// build output to `output`.
+func (executor *DockerExecutor) Build(ctx context.Context, buildContext []byte, tag string, output io.Writer) (string, error) {
+	if err := executor.connect(); err != nil {
+		return "", err
+	}
+	response, err := executor.client().ImageBuild(ctx, bytes.NewReader(buildContext), types.ImageBuildOptions{
+		Tags:        []string{tag},
+		Remove:      true,
+		ForceRemove: true,
+		PullParent:  true,
+	})
+	if err != nil {
+		return "", dockerError(err, "Failed to build image")
+	}
+	defer response.Body.Close()
+
+	// follow the build, which fails if any message is an error
+	decoder := json.NewDecoder(response.Body)
+	for {
+		message := buildMessage{}
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", dockerError(err, "Error while waiting for image build to finish")
+		}
+		switch {
+		case message.Error != "":
+			fmt.Fprintln(output, message.Error)
+			return "", dockerError(errors.New(message.Error), "Failed to build image")
+		case message.Stream != "":
+			io.WriteString(output, message.Stream)
+		case message.Status != "":
+			fmt.Fprintln(output, message.Status)
+		}
+	}
+
+	inspect, _, err := executor.client().ImageInspectWithRaw(ctx, tag)
+	if err != nil {
+		return "", dockerError(err, "Failed to inspect image")
+	}
+	return imageDigest(inspect), nil
+}
+
+// prepareImage pulls `image` if required by `policy` and inspects it.
+func (executor *DockerExecutor) prepareImage(ctx context.Context, image string, policy PullPolicy) (types.ImageInspect, error) {
+	if policy == "" {
+		policy = PullIfMissing
+	}
+
+	if policy != PullAlways {
+		inspect, _, err := executor.client().ImageInspectWithRaw(ctx, image)
+		if err == nil {
+			return inspect, nil
+		}
+		if !client.IsErrImageNotFound(err) {
+			return inspect, dockerError(err, "Failed to inspect image")
+		}
+		if policy == PullNever {
+			return inspect, ConfigError{fmt.Errorf("Image %v is not available and pull policy is %q", image, policy)}
+		}
+	}
+
+	// pull the required image from the registry
+	reader, err := executor.client().ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return types.ImageInspect{}, dockerError(err, "Failed to pull image")
+	}
+	defer reader.Close()
+	// wait for the pull to finish, which fails if any message is an error
+	decoder := json.NewDecoder(reader)
+	for {
+		message := buildMessage{}
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return types.ImageInspect{}, dockerError(err, "Error while waiting for image pull to finish")
+		}
+		if message.Error != "" {
+			return types.ImageInspect{}, dockerError(errors.New(message.Error), "Failed to pull image")
+		}
+	}
+
+	inspect, _, err := executor.client().ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return inspect, dockerError(err, "Failed to inspect image")
+	}
+	return inspect, nil
+}
+
+// imageDigest identifies an image as precisely as possible: by its registry
+// digest if it was pulled from a registry, by its ID otherwise.
+func imageDigest(inspect types.ImageInspect) string {
+	if len(inspect.RepoDigests) > 0 {
+		return inspect.RepoDigests[0]
+	}
+	return inspect.ID
+}
@@ -0,0 +1,70 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+)
+
+func TestMakeHostConfig(t *testing.T) {
+	tests := []struct {
+		desc      string
+		resources Resources
+		want      container.HostConfig
+	}{
+		{
+			desc: "no limits",
+		},
+		{
+			desc:      "memory without swap",
+			resources: Resources{Memory: 256 << 20},
+			want:      container.HostConfig{Resources: container.Resources{Memory: 256 << 20, MemorySwap: 256 << 20}},
+		},
+		{
+			desc:      "half a CPU",
+			resources: Resources{CPUs: 0.5},
+			want:      container.HostConfig{Resources: container.Resources{CPUPeriod: cpuPeriod, CPUQuota: cpuPeriod / 2}},
+		},
+		{
+			desc:      "processes and ulimits",
+			resources: Resources{PidsLimit: 64, Ulimits: []Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}}},
+			want: container.HostConfig{Resources: container.Resources{
+				PidsLimit: 64,
+				Ulimits:   []*units.Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}},
+			}},
+		},
+		{
+			desc:      "tmpfs and disk",
+			resources: Resources{TmpfsSize: 1024, DiskSize: 4096},
+			want: container.HostConfig{
+				Tmpfs:      map[string]string{"/tmp": "rw,exec,size=1024"},
+				StorageOpt: map[string]string{"size": "4096"},
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := makeHostConfig(test.resources); !reflect.DeepEqual(*got, test.want) {
+			t.Errorf("%v: got %+v, want %+v", test.desc, *got, test.want)
+		}
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	tests := []struct {
+		stats types.MemoryStats
+		want  int64
+	}{
+		{types.MemoryStats{Usage: 1000}, 1000},
+		{types.MemoryStats{Usage: 1000, Stats: map[string]uint64{"inactive_file": 300}}, 700},
+		{types.MemoryStats{Usage: 1000, Stats: map[string]uint64{"total_inactive_file": 400}}, 600},
+		{types.MemoryStats{Usage: 1000, Stats: map[string]uint64{"inactive_file": 2000}}, 0},
+	}
+	for _, test := range tests {
+		if got := memoryUsage(test.stats); got != test.want {
+			t.Errorf("memoryUsage(%+v) = %d, want %d", test.stats, got, test.want)
+		}
+	}
+}
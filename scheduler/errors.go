@@ -0,0 +1,61 @@
+package scheduler
+
+import (
+	"fmt"
+)
+
+// CheckerError is returned by executors for runs failing because of what was
+// run, the checker or the submission it grades, e.g. a results file that is
+// too large. Retrying such runs is pointless.
+type CheckerError struct {
+	Err error
+}
+
+func (err CheckerError) Error() string {
+	return err.Err.Error()
+}
+
+// ConfigError is returned by executors for runs that can't be set up as asked,
+// e.g. with an image that isn't available and can't be pulled. Retrying such
+// runs is pointless too, but the submission isn't to blame.
+type ConfigError struct {
+	Err error
+}
+
+func (err ConfigError) Error() string {
+	return err.Err.Error()
+}
+
+// InfraError is returned by executors for runs failing because of the
+// infrastructure in a way that may not happen again, e.g. an unreachable
+// Docker host or a registry timing out during a pull. Such runs are worth
+// retrying.
+type InfraError struct {
+	Err error
+}
+
+func (err InfraError) Error() string {
+	return err.Err.Error()
+}
+
+// IsInfraError reports whether `err`, returned by an executor, is an
+// InfraError. Errors not known to be transient aren't, so that runs failing
+// the same way every time aren't retried.
+func IsInfraError(err error) bool {
+	_, ok := err.(InfraError)
+	return ok
+}
+
+// wrapError prefixes the message of `err` with `prefix`, keeping its kind.
+func wrapError(err error, prefix string) error {
+	wrapped := fmt.Errorf("%v: %v", prefix, err)
+	switch err.(type) {
+	case CheckerError:
+		return CheckerError{wrapped}
+	case ConfigError:
+		return ConfigError{wrapped}
+	case InfraError:
+		return InfraError{wrapped}
+	}
+	return wrapped
+}
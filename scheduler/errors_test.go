@@ -0,0 +1,130 @@
+package scheduler
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestIsInfraError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("Failed to create container"), false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{CheckerError{errors.New("results file too large")}, false},
+		{ConfigError{errors.New("bad ulimit")}, false},
+		{InfraError{errors.New("No healthy Docker hosts")}, true},
+		{wrapError(InfraError{errors.New("connection refused")}, "tcp://10.0.0.2:2376"), true},
+	}
+	for _, test := range tests {
+		if got := IsInfraError(test.err); got != test.want {
+			t.Errorf("IsInfraError(%#v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	inner := errors.New("boom")
+	tests := []struct {
+		err     error
+		checker bool
+		config  bool
+		infra   bool
+	}{
+		{inner, false, false, false},
+		{CheckerError{inner}, true, false, false},
+		{ConfigError{inner}, false, true, false},
+		{InfraError{inner}, false, false, true},
+	}
+	for _, test := range tests {
+		err := wrapError(test.err, "host")
+		if err.Error() != "host: boom" {
+			t.Errorf("wrapError(%#v) message = %q, want %q", test.err, err.Error(), "host: boom")
+		}
+		_, checker := err.(CheckerError)
+		_, config := err.(ConfigError)
+		_, infra := err.(InfraError)
+		if checker != test.checker || config != test.config || infra != test.infra {
+			t.Errorf("wrapError(%#v) = %#v, kind not kept", test.err, err)
+		}
+	}
+}
+
+func TestDockerError(t *testing.T) {
+	tests := []struct {
+		err    error
+		infra  bool
+		config bool
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("refused")}, true, false},
+		{io.ErrUnexpectedEOF, true, false},
+		{errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock"), true, false},
+		{errors.New("Get https://registry-1.docker.io/v2/: net/http: TLS handshake timeout"), true, false},
+		{errors.New("toomanyrequests: You have reached your pull rate limit"), true, false},
+		{errors.New("Error response from daemon: Service Unavailable"), true, false},
+		{errors.New("invalid ulimit: nofile"), false, true},
+		{errors.New("pull access denied for lxchecker/missing"), false, true},
+		{errors.New("No such container: 1234"), false, true},
+		{context.Canceled, false, false},
+		{context.DeadlineExceeded, false, false},
+	}
+	for _, test := range tests {
+		err := dockerError(test.err, "Failed")
+		if err.Error() != "Failed: "+test.err.Error() {
+			t.Errorf("dockerError(%v) message = %q", test.err, err.Error())
+		}
+		_, config := err.(ConfigError)
+		if IsInfraError(err) != test.infra || config != test.config {
+			t.Errorf("dockerError(%v) = %#v, want infra %v, config %v", test.err, err, test.infra, test.config)
+		}
+	}
+}
+
+func TestSubmitRetries(t *testing.T) {
+	tests := []struct {
+		desc     string
+		err      error
+		cancel   bool
+		wantRuns int
+	}{
+		{"success", nil, false, 1},
+		{"checker error", CheckerError{errors.New("results file too large")}, false, 1},
+		{"config error", ConfigError{errors.New("bad ulimit")}, false, 1},
+		{"unknown error", errors.New("boom"), false, 1},
+		{"infra error, cancelled", InfraError{errors.New("connection reset")}, true, 1},
+	}
+	for _, test := range tests {
+		executor := NewFakeExecutor()
+		executor.RunFunc = func(options SubmitOptions) (SubmitResponse, error) {
+			return SubmitResponse{}, test.err
+		}
+		scheduler := New(executor)
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.cancel {
+			// the run itself isn't cancelled, only the retries
+			executor.RunFunc = func(options SubmitOptions) (SubmitResponse, error) {
+				cancel()
+				return SubmitResponse{}, test.err
+			}
+		}
+		retried := false
+		_, err := scheduler.Submit(ctx, SubmitOptions{
+			Image:    "lxchecker/test",
+			Retrying: func(error) { retried = true },
+		})
+		cancel()
+		if err != test.err {
+			t.Errorf("%v: got error %v, want %v", test.desc, err, test.err)
+		}
+		if runs := len(executor.Runs()); runs != test.wantRuns || retried {
+			t.Errorf("%v: ran %d times (retried: %v), want %d", test.desc, runs, retried, test.wantRuns)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package scheduler
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// FakeExecutor pretends to run submissions without running any checker. It
+// is meant for testing the layers above the scheduler.
+type FakeExecutor struct {
+	// RunFunc computes the response of each run. If nil, runs succeed
+	// with a score of 0.
+	RunFunc func(options SubmitOptions) (SubmitResponse, error)
+
+	mu   sync.Mutex
+	runs []SubmitOptions
+}
+
+// NewFakeExecutor creates a fake executor with the default behaviour.
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{}
+}
+
+// Pull pretends every image is available.
+func (executor *FakeExecutor) Pull(ctx context.Context, image string, policy PullPolicy) (string, error) {
+	return "fake:" + image, nil
+}
+
+// Build pretends to build the image.
+func (executor *FakeExecutor) Build(ctx context.Context, buildContext []byte, tag string, output io.Writer) (string, error) {
+	fmt.Fprintf(output, "fake build of %v\n", tag)
+	return "fake:" + tag, nil
+}
+
+// Ping always succeeds.
+func (executor *FakeExecutor) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Run records the submission and responds as told by RunFunc.
+func (executor *FakeExecutor) Run(ctx context.Context, options SubmitOptions) (SubmitResponse, error) {
+	executor.mu.Lock()
+	executor.runs = append(executor.runs, options)
+	executor.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return SubmitResponse{}, err
+	}
+	logs := []byte("fake run\n@score 0\n")
+	r := SubmitResponse{
+		Logs:        logs,
+		Stdout:      logs,
+		ImageDigest: "fake:" + options.Image,
+	}
+	if executor.RunFunc != nil {
+		var err error
+		if r, err = executor.RunFunc(options); err != nil {
+			return r, err
+		}
+	}
+	if options.Output != nil {
+		options.Output.Write(r.Logs)
+	}
+	return r, nil
+}
+
+// Runs returns the options of all runs so far.
+func (executor *FakeExecutor) Runs() []SubmitOptions {
+	executor.mu.Lock()
+	defer executor.mu.Unlock()
+	return append([]SubmitOptions(nil), executor.runs...)
+}
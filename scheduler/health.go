@@ -0,0 +1,104 @@
+package scheduler
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Health describes whether the executor of a scheduler is able to run
+// submissions, as of its last health check.
+type Health struct {
+	Healthy bool `json:"healthy"`
+	// Error is the reason the executor is unhealthy.
+	Error string `json:"error,omitempty"`
+	// CheckedAt is the time of the last check, Since the time the
+	// executor has been healthy, or unhealthy, since.
+	CheckedAt time.Time `json:"checked_at"`
+	Since     time.Time `json:"since"`
+}
+
+// Health checks happen every healthCheckInterval while the executor is
+// healthy. Once it isn't, they back off from minHealthBackoff to
+// maxHealthBackoff until it recovers.
+const (
+	healthCheckInterval = 10 * time.Second
+	healthCheckTimeout  = 10 * time.Second
+	minHealthBackoff    = time.Second
+	maxHealthBackoff    = time.Minute
+)
+
+// monitor checks the health of the executor until the process exits.
+func (scheduler *Scheduler) monitor() {
+	backoff := minHealthBackoff
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		err := scheduler.executor.Ping(ctx)
+		cancel()
+		scheduler.setHealth(err)
+
+		if err == nil {
+			backoff = minHealthBackoff
+			time.Sleep(healthCheckInterval)
+			continue
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxHealthBackoff {
+			backoff = maxHealthBackoff
+		}
+	}
+}
+
+// setHealth records the result of a health check.
+func (scheduler *Scheduler) setHealth(err error) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	now := time.Now()
+	healthy := err == nil
+	changed := healthy != scheduler.health.Healthy
+	if changed && healthy {
+		close(scheduler.healthy)
+	} else if changed {
+		scheduler.healthy = make(chan struct{})
+	}
+	if changed || scheduler.health.Since.IsZero() {
+		scheduler.health.Since = now
+		if healthy {
+			log.Printf("Executor is up\n")
+		} else {
+			log.Printf("Executor is down: %v\n", err)
+		}
+	}
+	scheduler.health.Healthy = healthy
+	scheduler.health.Error = ""
+	if err != nil {
+		scheduler.health.Error = err.Error()
+	}
+	scheduler.health.CheckedAt = now
+}
+
+// Health returns the health of the executor, as of its last check.
+func (scheduler *Scheduler) Health() Health {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	return scheduler.health
+}
+
+// waitHealthy waits for the executor to be healthy, for at most `timeout`.
+// It reports whether it is.
+func (scheduler *Scheduler) waitHealthy(ctx context.Context, timeout time.Duration) bool {
+	scheduler.mu.Lock()
+	healthy := scheduler.healthy
+	scheduler.mu.Unlock()
+
+	select {
+	case <-healthy:
+		return true
+	case <-time.After(timeout):
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,451 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AndreiDuma/lxchecker/util"
+	"golang.org/x/net/context"
+)
+
+// HostSpec describes a Docker host of a HostPool.
+type HostSpec struct {
+	// Address of the Docker daemon, e.g. "tcp://10.0.0.2:2376".
+	Address string
+	// Maximum number of submissions run on the host at the same time.
+	Capacity int
+}
+
+// ParseHostSpecs parses a comma-separated list of Docker hosts, each given as
+// "address=capacity", e.g. "tcp://10.0.0.2:2376=8,tcp://10.0.0.3:2376=4".
+func ParseHostSpecs(s string) ([]HostSpec, error) {
+	specs := []HostSpec{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.LastIndex(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("missing capacity for host %q", part)
+		}
+		capacity, err := strconv.Atoi(part[i+1:])
+		if err != nil || capacity <= 0 {
+			return nil, fmt.Errorf("bad capacity for host %q", part)
+		}
+		specs = append(specs, HostSpec{
+			Address:  part[:i],
+			Capacity: capacity,
+		})
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("no hosts given")
+	}
+	return specs, nil
+}
+
+// host is the state of a Docker host in a HostPool.
+type host struct {
+	spec     HostSpec
+	executor Executor
+
+	running int
+	healthy bool
+	// syncing is set while the host is getting the built images it
+	// misses, before being used.
+	syncing bool
+}
+
+// load is the fraction of the host's capacity in use.
+func (h *host) load() float64 {
+	return float64(h.running) / float64(h.spec.Capacity)
+}
+
+// HostPool is an executor spreading submissions over several Docker hosts.
+// Each submission goes to the least loaded healthy host with spare capacity,
+// waiting for one if all are busy. Hosts are health checked periodically,
+// and submissions failing because their host went away are moved to
+// another host. Hosts coming up build the images built by lxchecker they
+// miss before being used.
+type HostPool struct {
+	mu    sync.Mutex
+	hosts []*host
+	// changed is closed, and replaced, whenever capacity frees up.
+	changed chan struct{}
+	// builtImages returns the images hosts have to build if missing.
+	builtImages func() []BuiltImage
+}
+
+// hostCheckInterval is the time between two health checks of the hosts.
+const hostCheckInterval = 10 * time.Second
+
+// syncTimeout bounds the time a host coming up spends building the images
+// it misses.
+const syncTimeout = 30 * time.Minute
+
+// maxHostWait bounds the time a submission waits for a host when all of them
+// are down.
+const maxHostWait = time.Minute
+
+// NewHostPool creates a pool of the Docker hosts in `specs` and starts health
+// checking them. Hosts that are down are used once they come up.
+func NewHostPool(specs []HostSpec) *HostPool {
+	pool := &HostPool{changed: make(chan struct{})}
+	for _, spec := range specs {
+		executor := NewDockerExecutorForHost(spec.Address)
+		pool.hosts = append(pool.hosts, &host{spec: spec, executor: executor})
+	}
+
+	go func() {
+		pool.check()
+		for range time.Tick(hostCheckInterval) {
+			pool.check()
+		}
+	}()
+	return pool
+}
+
+// check pings all hosts in parallel and updates their health.
+func (pool *HostPool) check() {
+	var wg sync.WaitGroup
+	for _, h := range pool.hosts {
+		wg.Add(1)
+		go func(h *host) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), hostCheckInterval)
+			defer cancel()
+			pool.setHealthy(h, h.executor.Ping(ctx))
+		}(h)
+	}
+	wg.Wait()
+}
+
+// setHealthy records the result of a health check of `h`.
+func (pool *HostPool) setHealthy(h *host, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	healthy := err == nil
+	if healthy == h.healthy || healthy && h.syncing {
+		return
+	}
+	if !healthy {
+		h.healthy = false
+		log.Printf("Docker host %v is down: %v\n", h.spec.Address, err)
+		return
+	}
+	if pool.builtImages != nil {
+		h.syncing = true
+		go pool.syncImages(h)
+		return
+	}
+	h.healthy = true
+	log.Printf("Docker host %v is up\n", h.spec.Address)
+	pool.notify()
+}
+
+// SetBuiltImages makes hosts build the images returned by `images` that they
+// miss, as they come up. Hosts already up are synced right away, and aren't
+// used meanwhile.
+func (pool *HostPool) SetBuiltImages(images func() []BuiltImage) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.builtImages = images
+	for _, h := range pool.hosts {
+		if h.healthy && !h.syncing {
+			h.healthy = false
+			h.syncing = true
+			go pool.syncImages(h)
+		}
+	}
+}
+
+// syncImages builds the images `h` misses, then starts using it if it is
+// still up. Images that fail to build are only logged, submissions using them
+// failing later, but the host is left down if the daemon fails meanwhile,
+// until a later health check syncs it again.
+func (pool *HostPool) syncImages(h *host) {
+	defer util.LogPanics()
+	err := errors.New("Interrupted while syncing images")
+	defer func() {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		h.syncing = false
+		if err != nil {
+			log.Printf("Docker host %v is down: %v\n", h.spec.Address, err)
+			return
+		}
+		h.healthy = true
+		log.Printf("Docker host %v is up\n", h.spec.Address)
+		pool.notify()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+	defer cancel()
+	if err = pool.buildMissingImages(ctx, h); err != nil {
+		return
+	}
+	// the daemon may have gone away since the last health check
+	pingCtx, pingCancel := context.WithTimeout(context.Background(), hostCheckInterval)
+	defer pingCancel()
+	err = h.executor.Ping(pingCtx)
+}
+
+// buildMissingImages builds the images `h` misses. Only infrastructure errors
+// are returned.
+func (pool *HostPool) buildMissingImages(ctx context.Context, h *host) error {
+	builder, ok := h.executor.(Builder)
+	if !ok {
+		return nil
+	}
+	for _, image := range pool.builtImages() {
+		_, err := h.executor.Pull(ctx, image.Tag, PullNever)
+		if _, missing := err.(ConfigError); !missing {
+			if err != nil {
+				log.Printf("Failed to check image %v on Docker host %v: %v\n", image.Tag, h.spec.Address, err)
+				if IsInfraError(err) {
+					return err
+				}
+			}
+			continue
+		}
+		log.Printf("Building image %v on Docker host %v\n", image.Tag, h.spec.Address)
+		buildContext, err := image.Context()
+		if err == nil {
+			_, err = builder.Build(ctx, buildContext, image.Tag, ioutil.Discard)
+		}
+		if err != nil {
+			log.Printf("Failed to build image %v on Docker host %v: %v\n", image.Tag, h.spec.Address, err)
+			if IsInfraError(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// notify wakes up everyone waiting for a host. Must be called with the lock
+// held.
+func (pool *HostPool) notify() {
+	close(pool.changed)
+	pool.changed = make(chan struct{})
+}
+
+// acquire reserves a slot on the least loaded healthy host, waiting for one
+// to become available if needed. Hosts in `exclude` are skipped. If none of
+// the hosts is healthy for maxHostWait, an InfraError is returned.
+func (pool *HostPool) acquire(ctx context.Context, exclude map[*host]bool) (*host, error) {
+	if len(exclude) == len(pool.hosts) {
+		return nil, InfraError{errors.New("All Docker hosts failed")}
+	}
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		pool.mu.Lock()
+		var best *host
+		anyHealthy := false
+		for _, h := range pool.hosts {
+			if exclude[h] {
+				continue
+			}
+			// hosts getting their images will be usable soon
+			anyHealthy = anyHealthy || h.syncing
+			if !h.healthy {
+				continue
+			}
+			anyHealthy = true
+			if h.running >= h.spec.Capacity {
+				continue
+			}
+			if best == nil || h.load() < best.load() {
+				best = h
+			}
+		}
+		if best != nil {
+			best.running++
+			pool.mu.Unlock()
+			return best, nil
+		}
+		changed := pool.changed
+		pool.mu.Unlock()
+
+		// wait as long as needed for busy hosts, but not for hosts that
+		// are down
+		var deadline <-chan time.Time
+		if !anyHealthy {
+			if timer == nil {
+				timer = time.NewTimer(maxHostWait)
+			}
+			deadline = timer.C
+		} else if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return nil, InfraError{errors.New("No healthy Docker hosts")}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release frees the slot taken on `h` by acquire.
+func (pool *HostPool) release(h *host) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	h.running--
+	pool.notify()
+}
+
+// Pull makes the image available on all healthy hosts and returns its digest.
+func (pool *HostPool) Pull(ctx context.Context, image string, policy PullPolicy) (string, error) {
+	pool.mu.Lock()
+	hosts := []*host{}
+	for _, h := range pool.hosts {
+		if h.healthy {
+			hosts = append(hosts, h)
+		}
+	}
+	pool.mu.Unlock()
+	if len(hosts) == 0 {
+		return "", InfraError{errors.New("No healthy Docker hosts")}
+	}
+
+	type result struct {
+		digest string
+		err    error
+	}
+	results := make(chan result, len(hosts))
+	for _, h := range hosts {
+		go func(h *host) {
+			digest, err := h.executor.Pull(ctx, image, policy)
+			if err != nil {
+				err = wrapError(err, h.spec.Address)
+			}
+			results <- result{digest, err}
+		}(h)
+	}
+
+	digest, errs, transient := "", []string{}, true
+	for range hosts {
+		r := <-results
+		if r.err != nil {
+			errs = append(errs, r.err.Error())
+			transient = transient && IsInfraError(r.err)
+		} else if digest == "" {
+			digest = r.digest
+		}
+	}
+	if len(errs) > 0 {
+		err := errors.New(strings.Join(errs, "; "))
+		if transient {
+			return digest, InfraError{err}
+		}
+		return digest, err
+	}
+	return digest, nil
+}
+
+// Build builds the image on all healthy hosts, and those coming up, one after
+// the other, and returns its digest on the first one. Builds needn't be
+// reproducible, so the digests may differ between hosts. Hosts that are down
+// build the image as they come up, if it is among the built images in use.
+func (pool *HostPool) Build(ctx context.Context, buildContext []byte, tag string, output io.Writer) (string, error) {
+	pool.mu.Lock()
+	hosts := []*host{}
+	for _, h := range pool.hosts {
+		if h.healthy || h.syncing {
+			hosts = append(hosts, h)
+		}
+	}
+	pool.mu.Unlock()
+	if len(hosts) == 0 {
+		return "", InfraError{errors.New("No healthy Docker hosts")}
+	}
+
+	digest := ""
+	for _, h := range hosts {
+		builder, ok := h.executor.(Builder)
+		if !ok {
+			return "", ErrBuildUnsupported
+		}
+		fmt.Fprintf(output, "==> %v\n", h.spec.Address)
+		hostDigest, err := builder.Build(ctx, buildContext, tag, output)
+		if err != nil {
+			return "", fmt.Errorf("%v: %v", h.spec.Address, err)
+		}
+		if digest == "" {
+			digest = hostDigest
+		}
+	}
+	return digest, nil
+}
+
+// Run runs the submission on the least loaded host. If the run fails because
+// of the infrastructure and the host turns out to be down, the submission is
+// retried on another host.
+func (pool *HostPool) Run(ctx context.Context, options SubmitOptions) (SubmitResponse, error) {
+	failed := map[*host]bool{}
+	for {
+		h, err := pool.acquire(ctx, failed)
+		if err != nil {
+			return SubmitResponse{}, err
+		}
+		r, err := h.executor.Run(ctx, options)
+		pool.release(h)
+		if !IsInfraError(err) || ctx.Err() != nil {
+			return r, err
+		}
+
+		// keep the host unless it is unreachable
+		ctxPing, cancel := context.WithTimeout(ctx, hostCheckInterval)
+		pingErr := h.executor.Ping(ctxPing)
+		cancel()
+		if pingErr == nil {
+			return r, err
+		}
+		pool.setHealthy(h, pingErr)
+		failed[h] = true
+		log.Printf("Moving submission away from Docker host %v: %v\n", h.spec.Address, err)
+	}
+}
+
+// Debug opens the debug shell on the least loaded host, taking one of its
+// slots for the whole session.
+func (pool *HostPool) Debug(ctx context.Context, options SubmitOptions, session DebugSession) error {
+	h, err := pool.acquire(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer pool.release(h)
+	debugger, ok := h.executor.(Debugger)
+	if !ok {
+		return ErrDebugUnsupported
+	}
+	return debugger.Debug(ctx, options, session)
+}
+
+// Ping succeeds if at least one host is healthy.
+func (pool *HostPool) Ping(ctx context.Context) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, h := range pool.hosts {
+		if h.healthy {
+			return nil
+		}
+	}
+	return errors.New("No healthy Docker hosts")
+}
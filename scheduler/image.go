@@ -0,0 +1,29 @@
+package scheduler
+
+import (
+	"fmt"
+)
+
+// PullPolicy tells when an image is pulled from the registry.
+type PullPolicy string
+
+const (
+	// PullAlways pulls the image before every use.
+	PullAlways PullPolicy = "always"
+	// PullIfMissing pulls the image only if it's not available locally.
+	PullIfMissing PullPolicy = "if-missing"
+	// PullNever only uses locally available images.
+	PullNever PullPolicy = "never"
+)
+
+// ParsePullPolicy validates a pull policy. The empty string stands for
+// PullIfMissing.
+func ParsePullPolicy(s string) (PullPolicy, error) {
+	switch policy := PullPolicy(s); policy {
+	case "":
+		return PullIfMissing, nil
+	case PullAlways, PullIfMissing, PullNever:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown pull policy: %q", s)
+}
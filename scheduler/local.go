@@ -0,0 +1,107 @@
+package scheduler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// LocalExecutor runs submissions as plain processes on the local host,
+// isolated with Linux namespaces and limited with cgroups, without needing
+// Docker.
+//
+// Images are root filesystems stored as directories under ImageDir: image
+// "lxchecker/so_tema3" is the directory ImageDir/lxchecker/so_tema3. Each run
+// gets a private copy-on-write view of its image, in which the shell command
+// found in the image's /lxchecker-cmd file is run.
+//
+// Running submissions requires root privileges, but checkers run as the
+// assignment's user (which may not be root), without capabilities, unable to
+// gain privileges and, unless unconfined, behind a built-in seccomp filter
+// denying the same kind of system calls as Docker's default profile. Only
+// world-writable directories and the work directories can be written to.
+// The /tmp and disk size limits are not enforced, and neither are Docker
+// networks, added capabilities or custom seccomp profiles supported.
+type LocalExecutor struct {
+	ImageDir string
+
+	// WorkDir holds temporary per-run files. The system's temporary
+	// directory is used if empty.
+	WorkDir string
+
+	// CgroupRoot is a cgroup v2 directory delegated to lxchecker, under
+	// which a child cgroup is created for each run. Memory, CPU and
+	// process limits are only enforced if set.
+	CgroupRoot string
+}
+
+// localCmdFile holds the command run by LocalExecutor, relative to the root
+// of the image.
+const localCmdFile = "lxchecker-cmd"
+
+// NewLocalExecutor creates a local executor for the images in `imageDir`.
+func NewLocalExecutor(imageDir, workDir, cgroupRoot string) *LocalExecutor {
+	return &LocalExecutor{
+		ImageDir:   imageDir,
+		WorkDir:    workDir,
+		CgroupRoot: cgroupRoot,
+	}
+}
+
+// Pull checks that `image` exists, since local images can't be pulled from
+// anywhere.
+func (executor *LocalExecutor) Pull(ctx context.Context, image string, policy PullPolicy) (string, error) {
+	path, err := executor.imagePath(image)
+	if err != nil {
+		return "", err
+	}
+	return treeDigest(path)
+}
+
+// Ping checks that the image directory is accessible.
+func (executor *LocalExecutor) Ping(ctx context.Context) error {
+	info, err := os.Stat(executor.ImageDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", executor.ImageDir)
+	}
+	return nil
+}
+
+// imagePath returns the root filesystem of `image`.
+func (executor *LocalExecutor) imagePath(image string) (string, error) {
+	// Clean the name as an absolute path so that it can't escape ImageDir.
+	path := filepath.Join(executor.ImageDir, filepath.Clean("/"+image))
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return "", ConfigError{fmt.Errorf("Image %v is not available", image)}
+	}
+	return path, nil
+}
+
+// treeDigest identifies the contents of the directory `root` by hashing the
+// names, modes, sizes and modification times of all files under it.
+func treeDigest(root string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%q %v %d %d\n", rel, info.Mode(), info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to compute image digest: %v", err)
+	}
+	return "local:sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,199 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// localInitArg is the name lxchecker is run under by LocalExecutor to set up
+// the process of a run before executing the checker's command in it.
+const localInitArg = "lxchecker-local-init"
+
+// localInitConfig tells runLocalInit how to set up the process of a run.
+type localInitConfig struct {
+	Root     string // chrooted into
+	Uid, Gid int
+	Rlimits  []localRlimit
+	Seccomp  bool // apply the local seccomp filter
+	Command  string
+	Env      []string
+}
+
+// localRlimit is a resource limit set with setrlimit(2).
+type localRlimit struct {
+	Resource   int
+	Soft, Hard uint64
+}
+
+func init() {
+	if len(os.Args) == 2 && os.Args[0] == localInitArg {
+		runLocalInit(os.Args[1])
+	}
+}
+
+// runLocalInit sets up the process of a run as described by the JSON
+// `config`, then replaces it with the checker's command. Errors are written
+// to file descriptor 3, which is closed once the command is executed.
+func runLocalInit(config string) {
+	// the no_new_privs flag and the seccomp filter are only set for the
+	// calling thread, which must be the one executing the command
+	runtime.LockOSThread()
+	errors := os.NewFile(3, "errors")
+	syscall.CloseOnExec(3)
+	if err := localInit(config); err != nil {
+		fmt.Fprint(errors, err)
+		os.Exit(1)
+	}
+}
+
+func localInit(encodedConfig string) error {
+	config := localInitConfig{}
+	if err := json.Unmarshal([]byte(encodedConfig), &config); err != nil {
+		return err
+	}
+	if err := syscall.Chroot(config.Root); err != nil {
+		return fmt.Errorf("chroot: %v", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir: %v", err)
+	}
+
+	// limits may be raised only while still privileged
+	for _, limit := range config.Rlimits {
+		rlimit := syscall.Rlimit{Cur: limit.Soft, Max: limit.Hard}
+		if err := syscall.Setrlimit(limit.Resource, &rlimit); err != nil {
+			return fmt.Errorf("setrlimit %d: %v", limit.Resource, err)
+		}
+	}
+
+	// drop privileges, for all threads
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(config.Gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(config.Uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	// changing credentials clears the parent death signal
+	if err := unix.Prctl(unix.PR_SET_PDEATHSIG, uintptr(syscall.SIGKILL), 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl: %v", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("prctl: %v", err)
+	}
+	if config.Seccomp {
+		if err := loadSeccompFilter(); err != nil {
+			return fmt.Errorf("seccomp: %v", err)
+		}
+	}
+	return syscall.Exec("/bin/sh", []string{"/bin/sh", "-c", config.Command}, config.Env)
+}
+
+// seccompArches maps the architectures the local seccomp filter supports to
+// their audit architecture. Only little-endian ones are listed, the filter
+// reading the lower half of 64-bit arguments.
+var seccompArches = map[string]uint32{
+	"amd64":   unix.AUDIT_ARCH_X86_64,
+	"arm64":   unix.AUDIT_ARCH_AARCH64,
+	"ppc64le": unix.AUDIT_ARCH_PPC64LE,
+	"riscv64": unix.AUDIT_ARCH_RISCV64,
+}
+
+// seccompDenied lists the system calls denied by the local seccomp filter,
+// which checkers have no use for and which widen the kernel's attack
+// surface: kernel modules, mounts, namespaces, tracing of other processes,
+// keyrings, BPF and the like. The filter also denies creating namespaces
+// with clone(2), and makes clone3(2), whose flags it can't inspect, look
+// unimplemented so that the C library falls back to clone(2).
+var seccompDenied = []uintptr{
+	unix.SYS_ACCT, unix.SYS_ADD_KEY, unix.SYS_BPF, unix.SYS_CLOCK_ADJTIME,
+	unix.SYS_CLOCK_SETTIME, unix.SYS_DELETE_MODULE, unix.SYS_FANOTIFY_INIT,
+	unix.SYS_FINIT_MODULE, unix.SYS_FSCONFIG, unix.SYS_FSMOUNT,
+	unix.SYS_FSOPEN, unix.SYS_FSPICK, unix.SYS_INIT_MODULE,
+	unix.SYS_IO_URING_ENTER, unix.SYS_IO_URING_REGISTER,
+	unix.SYS_IO_URING_SETUP, unix.SYS_KCMP, unix.SYS_KEXEC_LOAD,
+	unix.SYS_KEYCTL, unix.SYS_LOOKUP_DCOOKIE, unix.SYS_MBIND,
+	unix.SYS_MOUNT, unix.SYS_MOVE_MOUNT, unix.SYS_MOVE_PAGES,
+	unix.SYS_NAME_TO_HANDLE_AT, unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_OPEN_TREE, unix.SYS_PERF_EVENT_OPEN, unix.SYS_PIVOT_ROOT,
+	unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV, unix.SYS_PTRACE,
+	unix.SYS_QUOTACTL, unix.SYS_REBOOT, unix.SYS_REQUEST_KEY,
+	unix.SYS_SET_MEMPOLICY, unix.SYS_SETNS, unix.SYS_SETTIMEOFDAY,
+	unix.SYS_SWAPOFF, unix.SYS_SWAPON, unix.SYS_SYSLOG, unix.SYS_UMOUNT2,
+	unix.SYS_UNSHARE, unix.SYS_USERFAULTFD,
+}
+
+// seccompNamespaceFlags are the clone(2) flags creating namespaces.
+const seccompNamespaceFlags = unix.CLONE_NEWNS | unix.CLONE_NEWCGROUP | unix.CLONE_NEWUTS |
+	unix.CLONE_NEWIPC | unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET
+
+// Seccomp return values and offsets in struct seccomp_data.
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArg0 = 16
+
+	// system calls of the x32 ABI have this bit set
+	seccompX32Bit = 0x40000000
+)
+
+// seccompFilter builds the BPF program of the local seccomp filter for
+// audit architecture `arch`. System calls of other architectures kill the
+// process.
+func seccompFilter(arch uint32) []unix.SockFilter {
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf int) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: uint8(jt), Jf: uint8(jf), K: k}
+	}
+	n := len(seccompDenied)
+	// jumps are relative to the next instruction; the program ends with
+	// the allow, deny and unimplemented returns
+	filter := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetKillProcess),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.SYS_CLONE3, n+6, 0),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.SYS_CLONE, 0, 2),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArg0),
+		jump(unix.BPF_JMP|unix.BPF_JSET|unix.BPF_K, seccompNamespaceFlags, n+2, n+1),
+		jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, seccompX32Bit, n+1, 0),
+	}
+	for i, nr := range seccompDenied {
+		filter = append(filter, jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), n-i, 0))
+	}
+	return append(filter,
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetAllow),
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.EPERM)),
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.ENOSYS)),
+	)
+}
+
+// loadSeccompFilter applies the local seccomp filter to the calling thread,
+// which must have the no_new_privs flag set.
+func loadSeccompFilter() error {
+	arch, ok := seccompArches[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("unsupported architecture %v", runtime.GOARCH)
+	}
+	filter := seccompFilter(arch)
+	program := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	return unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&program)), 0, 0)
+}
@@ -0,0 +1,568 @@
+package scheduler
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+)
+
+// rlimits maps ulimit names, as used by Docker, to resource numbers.
+var rlimits = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// Run mounts a private view of the image, places the submission inside it
+// and runs the image's command in new namespaces, waiting for it to exit.
+// Processes exceeding the timeout are killed.
+func (executor *LocalExecutor) Run(ctx context.Context, options SubmitOptions) (SubmitResponse, error) {
+	r := SubmitResponse{}
+
+	if options.Network != "" {
+		return r, ConfigError{fmt.Errorf("Networks are not supported by the local executor")}
+	}
+	if len(options.Security.CapAdd) > 0 {
+		return r, ConfigError{fmt.Errorf("Capabilities are not supported by the local executor")}
+	}
+	seccomp := options.Security.SeccompProfile != SeccompUnconfined
+	if seccomp && options.Security.SeccompProfile != "" {
+		return r, ConfigError{fmt.Errorf("Custom seccomp profiles are not supported by the local executor")}
+	}
+	if _, ok := seccompArches[runtime.GOARCH]; seccomp && !ok {
+		return r, ConfigError{fmt.Errorf("The local executor doesn't support seccomp on %v", runtime.GOARCH)}
+	}
+	config := localInitConfig{Seccomp: seccomp}
+	for _, u := range options.Resources.Ulimits {
+		resource, ok := rlimits[u.Name]
+		if !ok {
+			return r, ConfigError{fmt.Errorf("Unknown ulimit: %v", u.Name)}
+		}
+		config.Rlimits = append(config.Rlimits, localRlimit{resource, uint64(u.Soft), uint64(u.Hard)})
+	}
+
+	imagePath, err := executor.imagePath(options.Image)
+	if err != nil {
+		return r, err
+	}
+	if r.ImageDigest, err = treeDigest(imagePath); err != nil {
+		return r, err
+	}
+
+	// mount a copy-on-write view of the image, discarded after the run
+	runDir, err := ioutil.TempDir(executor.WorkDir, "lxchecker-")
+	if err != nil {
+		return r, fmt.Errorf("Failed to create run directory: %v", err)
+	}
+	defer os.RemoveAll(runDir)
+	upperDir := filepath.Join(runDir, "upper")
+	workDir := filepath.Join(runDir, "work")
+	root := filepath.Join(runDir, "root")
+	for _, dir := range []string{upperDir, workDir, root} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return r, fmt.Errorf("Failed to create run directory: %v", err)
+		}
+	}
+	overlay := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", imagePath, upperDir, workDir)
+	if err := syscall.Mount("overlay", root, "overlay", 0, overlay); err != nil {
+		return r, fmt.Errorf("Failed to mount image: %v", err)
+	}
+	defer func() {
+		if err := syscall.Unmount(root, syscall.MNT_DETACH); err != nil {
+			log.Printf("Failed to unmount %v: %v\n", root, err)
+		}
+	}()
+
+	// copy submission and fixtures to the image
+	if err := writeSubmission(root, options); err != nil {
+		return r, fmt.Errorf("Failed to copy submission: %v", err)
+	}
+	if err := writeFixtures(root, options); err != nil {
+		return r, fmt.Errorf("Failed to copy fixtures: %v", err)
+	}
+
+	if err := makeWritableDirs(root, options); err != nil {
+		return r, fmt.Errorf("Failed to create work directories: %v", err)
+	}
+
+	command := []byte(options.Command)
+	if options.Command == "" {
+		if command, err = ioutil.ReadFile(filepath.Join(root, localCmdFile)); err != nil {
+			return r, fmt.Errorf("Failed to read image command: %v", err)
+		}
+	}
+	config.Root = root
+	config.Command = string(command)
+	config.Env = []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOME=/",
+	}
+	if config.Uid, config.Gid, err = localCredential(root, options.Security.user()); err != nil {
+		return r, err
+	}
+	encodedConfig, err := json.Marshal(config)
+	if err != nil {
+		return r, err
+	}
+
+	// the command runs in its own namespaces and without network, set up
+	// by a copy of lxchecker (see runLocalInit) which reports its errors
+	// through a pipe closed once the command is executed
+	errorsReader, errorsWriter, err := os.Pipe()
+	if err != nil {
+		return r, fmt.Errorf("Failed to create pipe: %v", err)
+	}
+	defer errorsReader.Close()
+	logs := newRunLogs(options)
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       []string{localInitArg, string(encodedConfig)},
+		Env:        config.Env,
+		Dir:        "/",
+		Stdout:     logs.Stdout(),
+		Stderr:     logs.Stderr(),
+		ExtraFiles: []*os.File{errorsWriter},
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC |
+			syscall.CLONE_NEWUTS | syscall.CLONE_NEWNET,
+		Pdeathsig: syscall.SIGKILL,
+	}
+
+	// place the process in its own cgroup right from the start
+	cgroup := ""
+	if executor.CgroupRoot != "" {
+		cgroup = filepath.Join(executor.CgroupRoot, filepath.Base(runDir))
+		if err := makeCgroup(cgroup, options.Resources); err != nil {
+			return r, err
+		}
+		defer func() {
+			if err := os.Remove(cgroup); err != nil {
+				log.Printf("Failed to remove cgroup %v: %v\n", cgroup, err)
+			}
+		}()
+		fd, err := syscall.Open(cgroup, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			return r, fmt.Errorf("Failed to open cgroup: %v", err)
+		}
+		defer syscall.Close(fd)
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = fd
+	}
+
+	err = cmd.Start()
+	errorsWriter.Close()
+	if err != nil {
+		return r, fmt.Errorf("Failed to start process: %v", err)
+	}
+	started := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	if initError, _ := ioutil.ReadAll(errorsReader); len(initError) > 0 {
+		<-done
+		return r, fmt.Errorf("Failed to start process: %s", initError)
+	}
+
+	// wait for the process to exit; killing the first process of the PID
+	// namespace kills all the others
+	timer := time.NewTimer(options.Timeout)
+	defer timer.Stop()
+	select {
+	case err = <-done:
+	case <-timer.C:
+		// the process took too long, kill it but still collect its logs
+		r.TimedOut = true
+		cmd.Process.Kill()
+		err = <-done
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-done
+		return r, ctx.Err()
+	}
+	r.Metrics.WallTime = time.Since(started)
+	if cgroup != "" {
+		readCgroupMetrics(cgroup, &r.Metrics)
+	} else if cmd.ProcessState != nil {
+		// without a cgroup, fall back to what the kernel reports for
+		// the process and the descendants it waited for
+		if rusage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+			r.Metrics.CPUTime = time.Duration(rusage.Utime.Nano() + rusage.Stime.Nano())
+			r.Metrics.PeakMemory = rusage.Maxrss * 1024
+		}
+	}
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return r, fmt.Errorf("Wait failed: %v", err)
+		}
+		status := exitErr.Sys().(syscall.WaitStatus)
+		r.ExitCode = status.ExitStatus()
+		if status.Signaled() {
+			// report signals the same way Docker does
+			r.ExitCode = 128 + int(status.Signal())
+		}
+	}
+
+	logs.fill(&r)
+
+	// get the results file, if the checker wrote one
+	results, isArchive, err := readPath(root, options.resultsPath(), maxResultsSize)
+	if err != nil {
+		return r, wrapError(err, "Couldn't get results")
+	}
+	if isArchive {
+		return r, CheckerError{fmt.Errorf("Results file %v is a directory", options.resultsPath())}
+	}
+	r.Results = results
+
+	// collect the artifacts
+	for _, path := range options.Artifacts {
+		data, isArchive, err := readPath(root, path, maxArtifactSize)
+		if err != nil {
+			log.Printf("Couldn't get artifact %v: %v\n", path, err)
+			continue
+		}
+		if data != nil {
+			r.Artifacts = append(r.Artifacts, Artifact{path, data, isArchive})
+		}
+	}
+	return r, nil
+}
+
+// writeSubmission places the submission at options.SubmissionPath inside the
+// filesystem rooted at `root`, as a file or, if unpacked, as a directory.
+func writeSubmission(root string, options SubmitOptions) error {
+	submissionPath := filepath.Join(root, filepath.Clean("/"+options.SubmissionPath))
+	if options.SubmissionFiles == nil {
+		if err := os.MkdirAll(filepath.Dir(submissionPath), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(submissionPath, options.Submission, 0444)
+	}
+
+	// directories are writable, since checkers usually build the
+	// submission in place
+	for _, f := range options.SubmissionFiles {
+		name := filepath.Join(submissionPath, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(name, f.Data, os.FileMode(f.Mode|0444)); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(submissionPath, 0777)
+}
+
+// writeFixtures places the fixtures in the directory at options.FixturesPath
+// inside the filesystem rooted at `root`, read-only.
+func writeFixtures(root string, options SubmitOptions) error {
+	if options.Fixtures == nil {
+		return nil
+	}
+	fixturesPath := filepath.Join(root, filepath.Clean("/"+options.FixturesPath))
+	for _, f := range options.Fixtures {
+		name := filepath.Join(fixturesPath, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(name, f.Data, os.FileMode((f.Mode|0444)&^0222)); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(fixturesPath, 0755)
+}
+
+// makeWritableDirs lets the checker's user write to the writable
+// directories (see writableDirs) inside the filesystem rooted at `root`, and
+// to the directories of an unpacked submission.
+func makeWritableDirs(root string, options SubmitOptions) error {
+	dirs := []string{}
+	for _, dir := range writableDirs(options) {
+		if dir != "/" {
+			dirs = append(dirs, filepath.Join(root, filepath.FromSlash(dir)))
+		}
+	}
+	if options.SubmissionFiles != nil {
+		submissionPath := filepath.Join(root, filepath.Clean("/"+options.SubmissionPath))
+		err := filepath.Walk(submissionPath, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				dirs = append(dirs, path)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+		// MkdirAll is subject to the umask
+		if err := os.Chmod(dir, 0777); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localCredential resolves `user`, given as Docker does ("uid", "uid:gid",
+// "name" or "name:group"), to the ids the checker runs with, looking names up
+// in the image rooted at `root`. Users missing from the image's /etc/passwd
+// get a group with the same id. Root is refused, since it could escape the
+// run's chroot.
+func localCredential(root, user string) (int, int, error) {
+	name, group := user, ""
+	if i := strings.Index(user, ":"); i >= 0 {
+		name, group = user[:i], user[i+1:]
+	}
+
+	uid, err := strconv.Atoi(name)
+	if err != nil {
+		uid = -1
+	}
+	gid := uid
+	for _, fields := range readColonFile(filepath.Join(root, "etc", "passwd")) {
+		if len(fields) < 4 || (fields[0] != name && fields[2] != name) {
+			continue
+		}
+		entryUid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		entryGid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			continue
+		}
+		uid, gid = entryUid, entryGid
+		break
+	}
+	if uid < 0 {
+		return 0, 0, ConfigError{fmt.Errorf("Unknown user: %v", name)}
+	}
+
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			gid = -1
+			for _, fields := range readColonFile(filepath.Join(root, "etc", "group")) {
+				if len(fields) >= 3 && fields[0] == group {
+					if id, err := strconv.Atoi(fields[2]); err == nil {
+						gid = id
+						break
+					}
+				}
+			}
+		}
+		if gid < 0 {
+			return 0, 0, ConfigError{fmt.Errorf("Unknown group: %v", group)}
+		}
+	}
+	if uid == 0 {
+		return 0, 0, ConfigError{fmt.Errorf("The local executor can't run checkers as root")}
+	}
+	return uid, gid, nil
+}
+
+// readColonFile returns the fields of the lines of a file such as
+// /etc/passwd. Missing files, and symlinks (which would be resolved on the
+// host), are treated as empty.
+func readColonFile(path string) [][]string {
+	if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	entries := [][]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries
+}
+
+// readPath returns the contents of the file at `path` inside the filesystem
+// rooted at `root`, or a tar archive of it if it's a directory. nil is
+// returned if there's no such path. Contents larger than `maxSize` are
+// rejected.
+func readPath(root, path string, maxSize int64) ([]byte, bool, error) {
+	// symlinks are resolved on the host, so make sure they don't lead
+	// outside of root
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, false, err
+	}
+	path, err = filepath.EvalSymlinks(filepath.Join(root, filepath.Clean("/"+path)))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if !strings.HasPrefix(path, root+"/") {
+		return nil, false, CheckerError{fmt.Errorf("%v points outside of the container", path)}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if info.IsDir() {
+		data, err := tarDirectory(path, maxSize)
+		return data, true, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, false, CheckerError{fmt.Errorf("%v is not a regular file", path)}
+	}
+	if info.Size() > maxSize {
+		return nil, false, CheckerError{fmt.Errorf("%v is larger than %d bytes", path, maxSize)}
+	}
+	data, err := ioutil.ReadFile(path)
+	return data, false, err
+}
+
+// tarDirectory archives the regular files, directories and symlinks under
+// `dir`, placing them in a directory with the same name, as Docker does.
+// Archives larger than `maxSize` are rejected.
+func tarDirectory(dir string, maxSize int64) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	tw := tar.NewWriter(buffer)
+	parent := filepath.Dir(dir)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			// skip devices, sockets and the like
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		if header.Name, err = filepath.Rel(parent, path); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			if int64(buffer.Len())+info.Size() > maxSize {
+				return CheckerError{fmt.Errorf("%v is larger than %d bytes", dir, maxSize)}
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(tw, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// readCgroupMetrics fills `m` with the resource usage recorded by the cgroup
+// at `path`. Values the kernel doesn't provide are left alone.
+func readCgroupMetrics(path string, m *Metrics) {
+	if stat, err := readKeyedFile(filepath.Join(path, "cpu.stat")); err == nil {
+		m.CPUTime = time.Duration(stat["usage_usec"]) * time.Microsecond
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(path, "memory.peak")); err == nil {
+		fmt.Sscan(string(data), &m.PeakMemory)
+	}
+	if events, err := readKeyedFile(filepath.Join(path, "memory.events")); err == nil {
+		m.OOMKilled = events["oom_kill"] > 0
+	}
+}
+
+// readKeyedFile parses a cgroup file made of "key value" lines.
+func readKeyedFile(path string) (map[string]int64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]int64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		var key string
+		var value int64
+		if n, _ := fmt.Sscan(line, &key, &value); n == 2 {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// makeCgroup creates a cgroup v2 at `path` enforcing `resources`.
+func makeCgroup(path string, resources Resources) error {
+	if err := os.Mkdir(path, 0755); err != nil {
+		return fmt.Errorf("Failed to create cgroup: %v", err)
+	}
+	limits := map[string]string{}
+	if resources.Memory > 0 {
+		limits["memory.max"] = fmt.Sprint(resources.Memory)
+		// don't allow swapping either
+		limits["memory.swap.max"] = "0"
+	}
+	if resources.CPUs > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d %d", int64(resources.CPUs*cpuPeriod), cpuPeriod)
+	}
+	if resources.PidsLimit > 0 {
+		limits["pids.max"] = fmt.Sprint(resources.PidsLimit)
+	}
+	for file, value := range limits {
+		if err := ioutil.WriteFile(filepath.Join(path, file), []byte(value), 0644); err != nil {
+			os.Remove(path)
+			return fmt.Errorf("Failed to set cgroup limit %v: %v", file, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package scheduler
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+// Run fails, since namespaces and cgroups are only available on Linux.
+func (executor *LocalExecutor) Run(ctx context.Context, options SubmitOptions) (SubmitResponse, error) {
+	return SubmitResponse{}, ConfigError{errors.New("The local executor only works on Linux")}
+}
@@ -0,0 +1,90 @@
+package scheduler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultMaxLogSize is the log cap used unless SubmitOptions say otherwise.
+const DefaultMaxLogSize = 1024 * 1024
+
+// cappedBuffer holds up to a maximum number of bytes, replacing whatever
+// comes after with a truncation marker.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+// write appends as much of `p` as fits in `max` bytes and returns what was
+// actually appended, including the truncation marker.
+func (b *cappedBuffer) write(p []byte, max int64) []byte {
+	if b.truncated {
+		return nil
+	}
+	room := max - int64(b.buf.Len())
+	if int64(len(p)) <= room {
+		b.buf.Write(p)
+		return p
+	}
+	b.truncated = true
+	written := append(p[:room:room], fmt.Sprintf("\n[output truncated after %d bytes]\n", max)...)
+	b.buf.Write(written)
+	return written
+}
+
+// runLogs collects the stdout and stderr of a run, separately and
+// interleaved, each capped to the same size. The interleaved logs are also
+// forwarded to an optional output.
+type runLogs struct {
+	mu     sync.Mutex
+	max    int64
+	output io.Writer
+
+	combined, stdout, stderr cappedBuffer
+}
+
+func newRunLogs(options SubmitOptions) *runLogs {
+	max := options.MaxLogSize
+	if max <= 0 {
+		max = DefaultMaxLogSize
+	}
+	return &runLogs{max: max, output: options.Output}
+}
+
+// streamWriter writes to one of the streams of runLogs.
+type streamWriter struct {
+	logs   *runLogs
+	stream *cappedBuffer
+}
+
+// Write never fails, so that the process keeps running once its output
+// exceeds the cap.
+func (w streamWriter) Write(p []byte) (int, error) {
+	w.logs.mu.Lock()
+	defer w.logs.mu.Unlock()
+	w.stream.write(p, w.logs.max)
+	if written := w.logs.combined.write(p, w.logs.max); len(written) > 0 && w.logs.output != nil {
+		w.logs.output.Write(written)
+	}
+	return len(p), nil
+}
+
+func (l *runLogs) Stdout() io.Writer {
+	return streamWriter{l, &l.stdout}
+}
+
+func (l *runLogs) Stderr() io.Writer {
+	return streamWriter{l, &l.stderr}
+}
+
+// fill stores the logs collected so far in `r`.
+func (l *runLogs) fill(r *SubmitResponse) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r.Logs = append([]byte(nil), l.combined.buf.Bytes()...)
+	r.Stdout = append([]byte(nil), l.stdout.buf.Bytes()...)
+	r.Stderr = append([]byte(nil), l.stderr.buf.Bytes()...)
+	r.LogsTruncated = l.combined.truncated || l.stdout.truncated || l.stderr.truncated
+}
@@ -0,0 +1,284 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/util"
+	"golang.org/x/net/context"
+)
+
+// JobHandler runs a single job. The context is cancelled if the job is
+// reclaimed from the worker running it.
+type JobHandler func(ctx context.Context, job *db.Job)
+
+// PoolOptions holds parameters for NewPool.
+type PoolOptions struct {
+	// Number of jobs run concurrently.
+	Workers int
+	// How often idle workers look for new jobs if not notified.
+	PollInterval time.Duration
+	// How often running jobs are marked as alive.
+	HeartbeatInterval time.Duration
+	// How long a running job may go without a heartbeat before the
+	// watchdog puts it back in the queue.
+	StaleAfter time.Duration
+	// Maximum number of jobs running at the same time for a single user
+	// or assignment, across all pools. Zero means no limit.
+	MaxPerUser       int
+	MaxPerAssignment int
+}
+
+// Pool is a set of workers consuming jobs from the persistent queue in
+// package db.
+type Pool struct {
+	handler JobHandler
+	options PoolOptions
+
+	// notify wakes up an idle worker when a new job is enqueued.
+	notify chan struct{}
+
+	// claimMu serializes the claims of the pool's workers, which would
+	// otherwise race for the same jobs.
+	claimMu sync.Mutex
+
+	// cancels holds the cancel functions of the jobs running in this
+	// process, by job id.
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+
+	startOnce sync.Once
+}
+
+// NewPool creates a worker pool running `handler` for every job. Zero values
+// in `options` are replaced by sensible defaults.
+func NewPool(handler JobHandler, options PoolOptions) *Pool {
+	if options.Workers <= 0 {
+		options.Workers = 4
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = 5 * time.Second
+	}
+	if options.HeartbeatInterval <= 0 {
+		options.HeartbeatInterval = 10 * time.Second
+	}
+	if options.StaleAfter <= 0 {
+		options.StaleAfter = 6 * options.HeartbeatInterval
+	}
+	return &Pool{
+		handler: handler,
+		options: options,
+		notify:  make(chan struct{}, options.Workers),
+		cancels: map[string]context.CancelFunc{},
+	}
+}
+
+// Start requeues jobs left running by a previous instance, as long as their
+// heartbeats show they are no longer run by another one, and queues
+// submissions left without a job. It then starts the workers and the
+// watchdog.
+func (pool *Pool) Start() {
+	pool.startOnce.Do(func() {
+		if n := db.RequeueJobs(time.Now().Add(-pool.options.StaleAfter)); n > 0 {
+			log.Printf("requeued %d interrupted jobs\n", n)
+		}
+		if n := pool.enqueueOrphans(); n > 0 {
+			log.Printf("queued %d submissions without a job\n", n)
+		}
+
+		hostname, _ := os.Hostname()
+		for i := 0; i < pool.options.Workers; i++ {
+			go pool.work(fmt.Sprintf("%v/%v/%v", hostname, os.Getpid(), i))
+		}
+		go pool.watch()
+	})
+}
+
+// Enqueue adds a job for submission `s` to the queue and wakes up an idle
+// worker. Jobs with a lower `priority` (e.g. db.JobPriorityInteractive) run
+// first. Submissions already having a job are left alone.
+func (pool *Pool) Enqueue(s *db.Submission, priority int) error {
+	if err := insertJob(s, priority); err != nil && err != db.ErrAlreadyExists {
+		return err
+	}
+	pool.wake()
+	return nil
+}
+
+func insertJob(s *db.Submission, priority int) error {
+	return db.InsertJob(&db.Job{
+		Id:            db.NewJobId(),
+		SubjectId:     s.SubjectId,
+		AssignmentId:  s.AssignmentId,
+		SubmissionId:  s.Id,
+		OwnerUsername: s.OwnerUsername,
+		Priority:      priority,
+	})
+}
+
+// enqueueOrphans adds a job for every queued submission without one, e.g.
+// because the server stopped right after saving it, or because it was
+// regraded while its cancelled job was still being stopped. Submissions
+// uploaded less than StaleAfter ago are left to their uploader. Their origin
+// being unknown, the jobs run after interactive ones. It returns the number
+// of added jobs.
+func (pool *Pool) enqueueOrphans() int {
+	n := 0
+	for _, s := range db.GetSubmissionsWithoutJob(time.Now().Add(-pool.options.StaleAfter)) {
+		// The submission may have been queued meanwhile.
+		if err := insertJob(&s, db.JobPriorityBulk); err == nil {
+			n++
+		} else if err != db.ErrAlreadyExists {
+			panic(err)
+		}
+	}
+	if n > 0 {
+		pool.wake()
+	}
+	return n
+}
+
+// Cancel stops the job of the given submission. Queued jobs are dropped,
+// running ones are stopped by their worker: right away if it belongs to this
+// pool, at its next heartbeat otherwise. ErrNotFound is returned if the
+// submission has no queued or running job.
+func (pool *Pool) Cancel(subjectId, assignmentId, submissionId string) error {
+	job, err := db.CancelJob(subjectId, assignmentId, submissionId)
+	if err != nil {
+		return err
+	}
+	if job.Status == db.JobRunning {
+		pool.mu.Lock()
+		cancel := pool.cancels[job.Id]
+		pool.mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+	}
+	return nil
+}
+
+func (pool *Pool) wake() {
+	select {
+	case pool.notify <- struct{}{}:
+	default:
+		// All workers are busy or already notified.
+	}
+}
+
+// work claims and runs jobs until the process exits.
+func (pool *Pool) work(workerId string) {
+	for {
+		job, err := pool.claim(workerId)
+		if err != nil {
+			// Nothing to do, wait for a notification or poll again later.
+			select {
+			case <-pool.notify:
+			case <-time.After(pool.options.PollInterval):
+			}
+			continue
+		}
+		pool.run(job)
+	}
+}
+
+// claim wraps db.ClaimJob, turning panics (e.g. a lost MongoDB connection)
+// into errors so that workers survive them.
+func (pool *Pool) claim(workerId string) (job *db.Job, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic while claiming job: %v\n", r)
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	pool.claimMu.Lock()
+	defer pool.claimMu.Unlock()
+	return db.ClaimJob(workerId, db.ClaimLimits{
+		MaxPerUser:       pool.options.MaxPerUser,
+		MaxPerAssignment: pool.options.MaxPerAssignment,
+	})
+}
+
+// run executes the handler for `job` while periodically sending heartbeats.
+func (pool *Pool) run(job *db.Job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	pool.mu.Lock()
+	pool.cancels[job.Id] = cancel
+	pool.mu.Unlock()
+	defer func() {
+		pool.mu.Lock()
+		delete(pool.cancels, job.Id)
+		pool.mu.Unlock()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(pool.options.HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !pool.heartbeat(job) {
+					// Someone else owns this job now, or it was
+					// cancelled, give up on it.
+					log.Printf("job %v was reclaimed or cancelled, stopping\n", job.Id)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	func() {
+		defer util.LogPanics()
+		pool.handler(ctx, job)
+	}()
+	close(done)
+
+	// Unless the job was reclaimed meanwhile, it is now finished. Cancelled
+	// jobs are removed as well.
+	func() {
+		defer util.LogPanics()
+		if ctx.Err() == nil {
+			db.RemoveJob(job)
+		} else {
+			db.RemoveCancelledJob(job)
+		}
+	}()
+	cancel()
+
+	// Jobs held back by the limits may be able to run now.
+	pool.wake()
+}
+
+// heartbeat marks `job` as alive and reports whether it still belongs to
+// this worker. Database errors are logged and do not count as losing the job.
+func (pool *Pool) heartbeat(job *db.Job) (owned bool) {
+	owned = true
+	defer util.LogPanics()
+	return db.HeartbeatJob(job) != db.ErrNotFound
+}
+
+// watch periodically requeues jobs whose worker stopped sending heartbeats,
+// and queues submissions left without a job.
+func (pool *Pool) watch() {
+	for range time.Tick(pool.options.StaleAfter / 2) {
+		func() {
+			defer util.LogPanics()
+			if n := db.RequeueJobs(time.Now().Add(-pool.options.StaleAfter)); n > 0 {
+				log.Printf("watchdog requeued %d stale jobs\n", n)
+				pool.wake()
+			}
+			if n := pool.enqueueOrphans(); n > 0 {
+				log.Printf("watchdog queued %d submissions without a job\n", n)
+			}
+		}()
+	}
+}
@@ -1,132 +1,256 @@
 package scheduler
 
 import (
-	"archive/tar"
-	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"log"
+	"os"
+	"sync"
 	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
+	"github.com/AndreiDuma/lxchecker/util"
 	"golang.org/x/net/context"
 )
 
-// makeSubmissionTar creates a tar archive from `submission`.
-// The submission is place at `path` inside the archive.
-func makeSubmissionTar(submission []byte, path string) (io.Reader, error) {
-	buffer := new(bytes.Buffer)
-	tw := tar.NewWriter(buffer)
-
-	if err := tw.WriteHeader(&tar.Header{
-		Name: path,
-		Mode: 0444,
-		Size: int64(len(submission)),
-	}); err != nil {
-		return nil, err
-	}
-	if _, err := tw.Write(submission); err != nil {
-		return nil, err
-	}
-	if err := tw.Close(); err != nil {
-		return nil, err
-	}
-	return buffer, nil
+// Ulimit is a resource limit set with setrlimit(2) in the container.
+type Ulimit struct {
+	Name string
+	Soft int64
+	Hard int64
 }
 
+// Resources holds the limits applied to a container. Zero values mean no
+// limit.
+type Resources struct {
+	Memory    int64 // in bytes
+	CPUs      float64
+	PidsLimit int64
+	Ulimits   []Ulimit
+	TmpfsSize int64 // in bytes, for the tmpfs mounted at /tmp
+	DiskSize  int64 // in bytes, for the container's filesystem
+}
+
+// cpuPeriod is the CFS scheduler period, in microseconds, used to enforce CPU
+// limits.
+const cpuPeriod = 100000
+
 // SubmitOptions holds parameters for Submit.
 type SubmitOptions struct {
 	Image          string
+	PullPolicy     PullPolicy
 	Submission     []byte
 	SubmissionPath string
 	Timeout        time.Duration
+
+	// Command, if set, is run with /bin/sh -c instead of the image's
+	// default command.
+	Command string
+
+	// SubmissionFiles, if set, holds an unpacked submission, placed in
+	// the directory at SubmissionPath instead of Submission.
+	SubmissionFiles []util.File
+
+	// Fixtures, if set, are placed in the directory at FixturesPath,
+	// readable but not writable by the checker.
+	Fixtures     []util.File
+	FixturesPath string
+
+	Resources Resources
+
+	// Security confines the container, hardened by default.
+	Security Security
+
+	// Name of an internal Docker network to attach the container to.
+	// Networking is disabled if empty.
+	Network string
+
+	// Output, if set, receives the logs while they are being produced.
+	Output io.Writer
+
+	// MaxLogSize caps the logs kept from each stream. Defaults to
+	// DefaultMaxLogSize.
+	MaxLogSize int64
+
+	// Path of the results file written by the checker. Defaults to
+	// DefaultResultsPath.
+	ResultsPath string
+
+	// Paths of files or directories to collect after the run.
+	Artifacts []string
+
+	// Retrying, if set, is called before a run that failed because of the
+	// infrastructure is retried, e.g. to drop the output of the failed
+	// attempt.
+	Retrying func(err error)
+}
+
+// DefaultResultsPath is where checkers write their results file unless
+// told otherwise.
+const DefaultResultsPath = "/lxchecker/results.json"
+
+// maxResultsSize bounds the size of results files.
+const maxResultsSize = 1024 * 1024
+
+// maxArtifactSize bounds the size of each artifact.
+const maxArtifactSize = 16 * 1024 * 1024
+
+func (options SubmitOptions) resultsPath() string {
+	if options.ResultsPath == "" {
+		return DefaultResultsPath
+	}
+	return options.ResultsPath
 }
 
 // SubmitResponse holds data returned from Submit.
 type SubmitResponse struct {
-	Logs     []byte
+	// Logs interleaves Stdout and Stderr as they were produced. Each of
+	// them ends with a truncation marker if it exceeded the log cap.
+	Logs          []byte
+	Stdout        []byte
+	Stderr        []byte
+	LogsTruncated bool
+
 	ExitCode int
+
+	// ImageDigest identifies the exact image used for the run.
+	ImageDigest string
+
+	// Results holds the contents of the results file, if the checker
+	// wrote one.
+	Results []byte
+
+	// Artifacts holds the requested artifacts that were found.
+	Artifacts []Artifact
+
+	// TimedOut is set if the container was killed for exceeding the
+	// timeout. ExitCode is meaningless in that case.
+	TimedOut bool
+
+	Metrics Metrics
 }
 
-type Scheduler struct {
-	cli *client.Client
+// Metrics describes the resources used by a run.
+type Metrics struct {
+	WallTime time.Duration
+	CPUTime  time.Duration
+	// PeakMemory is the highest memory usage seen, in bytes. Docker only
+	// samples it, so short peaks may be missed.
+	PeakMemory int64
+	// OOMKilled is set if the run was killed for exceeding its memory
+	// limit.
+	OOMKilled bool
 }
 
-// New creates a new scheduler object, encapsulating a connection to a Docker
-// host.
-func New() *Scheduler {
-	var err error
-	scheduler := &Scheduler{}
-	if scheduler.cli, err = client.NewEnvClient(); err != nil {
-		panic(err)
-	}
-	return scheduler
+// Executor is a backend able to run submissions in isolation.
+type Executor interface {
+	// Pull makes sure `image` is available according to `policy` and
+	// returns its digest.
+	Pull(ctx context.Context, image string, policy PullPolicy) (string, error)
+
+	// Run runs a submission to completion and returns its output.
+	Run(ctx context.Context, options SubmitOptions) (SubmitResponse, error)
+
+	// Ping checks whether the executor is able to run submissions.
+	Ping(ctx context.Context) error
 }
 
-// Submit prepares a submission, creates a container for it, starts it, waits
-// for it to exit and returns the logs.
-func (scheduler *Scheduler) Submit(ctx context.Context, options SubmitOptions) (SubmitResponse, error) {
-	r := SubmitResponse{}
+// Artifact is a file or directory collected after a run.
+type Artifact struct {
+	Path string
+	// Data holds the contents of the file, or a tar archive of the
+	// directory.
+	Data      []byte
+	IsArchive bool
+}
 
-	// pull the required image from the registry
-	// TODO: figure out a way to make this faster
-	reader, err := scheduler.cli.ImagePull(ctx, options.Image, types.ImagePullOptions{})
-	if err != nil {
-		return r, fmt.Errorf("Failed to pull image: %v", err)
-	}
-	// wait for the pull to finish
-	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
-		return r, fmt.Errorf("Error while waiting for image pull to finish: %v", err)
-	}
-	reader.Close()
+type Scheduler struct {
+	executor Executor
 
-	// create the container
-	config := &container.Config{
-		Image: options.Image,
-		Tty:   true,
-	}
-	container, err := scheduler.cli.ContainerCreate(ctx, config, nil, nil, "")
-	if err != nil {
-		return r, fmt.Errorf("Failed to create container: %v", err)
-	}
+	mu     sync.Mutex
+	health Health
+	// healthy is closed while the executor is healthy.
+	healthy chan struct{}
+}
 
-	// tar the submission
-	tar, err := makeSubmissionTar(options.Submission, options.SubmissionPath)
-	if err != nil {
-		return r, fmt.Errorf("Couldn't tar submission: %v", err)
-	}
+// Runs failing because of the infrastructure are attempted at most
+// maxAttempts times. Before each retry, the scheduler waits for
+// retryDelay, doubled after every attempt, and then for the executor to be
+// healthy, for at most maxRetryWait.
+const (
+	maxAttempts  = 3
+	retryDelay   = 5 * time.Second
+	maxRetryWait = 10 * time.Minute
+)
 
-	// copy submission to container
-	if err = scheduler.cli.CopyToContainer(ctx, container.ID, "/", tar, types.CopyToContainerOptions{}); err != nil {
-		return r, fmt.Errorf("Failed to copy submission to container: %v", err)
+// New creates a new scheduler object, running submissions with `executor`.
+// The executor needn't be reachable yet: its health is checked in the
+// background until it is.
+func New(executor Executor) *Scheduler {
+	scheduler := &Scheduler{
+		executor: executor,
+		healthy:  make(chan struct{}),
 	}
+	go scheduler.monitor()
+	return scheduler
+}
 
-	// start the container
-	if err = scheduler.cli.ContainerStart(ctx, container.ID, types.ContainerStartOptions{}); err != nil {
-		return r, fmt.Errorf("Failed to start container: %v", err)
-	}
+// Submit runs a submission and returns its logs. Runs failing because of the
+// infrastructure are retried a few times, once the executor is healthy again;
+// other errors are returned right away.
+func (scheduler *Scheduler) Submit(ctx context.Context, options SubmitOptions) (SubmitResponse, error) {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		r, err := scheduler.executor.Run(ctx, options)
+		if !IsInfraError(err) || attempt == maxAttempts || ctx.Err() != nil {
+			return r, err
+		}
 
-	// wait for the container to exit
-	ctxWait, cancel := context.WithTimeout(ctx, options.Timeout)
-	r.ExitCode, err = scheduler.cli.ContainerWait(ctxWait, container.ID)
-	cancel()
-	if err != nil {
-		return r, fmt.Errorf("Wait failed: %v", err)
+		log.Printf("Run failed because of the infrastructure, retrying (attempt %d of %d): %v\n", attempt+1, maxAttempts, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return r, err
+		}
+		delay *= 2
+		if !scheduler.waitHealthy(ctx, maxRetryWait) {
+			return r, err
+		}
+		if options.Retrying != nil {
+			options.Retrying(err)
+		}
 	}
+}
 
-	// get container logs
-	logsOptions := types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-	}
-	logsReader, err := scheduler.cli.ContainerLogs(ctx, container.ID, logsOptions)
-	if err != nil {
-		return r, fmt.Errorf("Couldn't get logs from container: %v", err)
-	}
-	if r.Logs, err = ioutil.ReadAll(logsReader); err != nil {
-		return r, fmt.Errorf("Failed reading the logs: %v", err)
+// Pull makes sure `image` is available according to `policy` and returns its
+// digest.
+func (scheduler *Scheduler) Pull(ctx context.Context, image string, policy PullPolicy) (string, error) {
+	return scheduler.executor.Pull(ctx, image, policy)
+}
+
+// NewExecutor creates the executor named `name`: "docker" (the default),
+// "local" or "fake", configured through the environment. The "docker"
+// executor spreads submissions over the hosts in LXCHECKER_DOCKER_HOSTS if
+// set, and the "local" one finds its images in LXCHECKER_LOCAL_IMAGES.
+func NewExecutor(name string) (Executor, error) {
+	switch name {
+	case "", "docker":
+		// use a pool of Docker hosts if configured
+		if hosts := os.Getenv("LXCHECKER_DOCKER_HOSTS"); hosts != "" {
+			specs, err := ParseHostSpecs(hosts)
+			if err != nil {
+				return nil, err
+			}
+			return NewHostPool(specs), nil
+		}
+		return NewDockerExecutor(), nil
+	case "local":
+		return NewLocalExecutor(
+			os.Getenv("LXCHECKER_LOCAL_IMAGES"),
+			os.Getenv("LXCHECKER_LOCAL_WORKDIR"),
+			os.Getenv("LXCHECKER_CGROUP_ROOT"),
+		), nil
+	case "fake":
+		return NewFakeExecutor(), nil
 	}
-	return r, nil
+	return nil, fmt.Errorf("unknown executor %q", name)
 }
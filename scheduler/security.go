@@ -0,0 +1,114 @@
+package scheduler
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Security describes how tightly a container is confined. The zero value is
+// the hardened default: the checker runs as DefaultUser with no capabilities,
+// can't gain privileges, is restricted by Docker's default seccomp profile
+// (an allowlist) and has a read-only root filesystem. Only /tmp and the work
+// directories (see workDirs) are writable then.
+//
+// There's no seccomp profile of our own: Docker's default one already denies
+// whatever isn't known to be safe, and is kept up to date with new kernels
+// and architectures, which a profile of ours would have to keep up with to
+// be as strict.
+type Security struct {
+	// User the checker runs as, e.g. "1000:1000" or "root". Defaults to
+	// DefaultUser.
+	User string
+
+	// CapAdd lists the capabilities given back after dropping all of
+	// them, e.g. "SYS_PTRACE" for debuggers.
+	CapAdd []string
+
+	// WritableRootfs leaves the root filesystem writable, for checkers
+	// writing outside the work directories.
+	WritableRootfs bool
+
+	// SeccompProfile is a seccomp profile in Docker's JSON format, or
+	// "unconfined" to disable seccomp. Docker's default profile applies if
+	// empty.
+	SeccompProfile string
+}
+
+// DefaultUser is the user checkers run as unless told otherwise: nobody.
+const DefaultUser = "65534:65534"
+
+// SeccompUnconfined disables seccomp filtering when used as a profile.
+const SeccompUnconfined = "unconfined"
+
+// DefaultTmpfsSize is the size of the tmpfs mounted at /tmp when the root
+// filesystem is read-only and no size was asked for.
+const DefaultTmpfsSize = 64 * 1024 * 1024
+
+func (security Security) user() string {
+	if security.User == "" {
+		return DefaultUser
+	}
+	return security.User
+}
+
+// writableDirs returns the directories the checker must be able to write to,
+// whatever its user: the one holding the submission (or the submission
+// itself, if unpacked), the one holding the results file and those holding
+// artifacts.
+func writableDirs(options SubmitOptions) []string {
+	submissionPath := path.Clean("/" + options.SubmissionPath)
+	if options.SubmissionFiles == nil {
+		submissionPath = path.Dir(submissionPath)
+	}
+	dirs := []string{submissionPath, path.Dir(path.Clean("/" + options.resultsPath()))}
+	for _, artifact := range options.Artifacts {
+		dirs = append(dirs, path.Dir(path.Clean("/"+artifact)))
+	}
+
+	// sorted, parents come before their children
+	sort.Strings(dirs)
+	unique := []string{}
+	for _, dir := range dirs {
+		if len(unique) == 0 || unique[len(unique)-1] != dir {
+			unique = append(unique, dir)
+		}
+	}
+	return unique
+}
+
+// workDirs returns the outermost of the writable directories and of the
+// fixtures directory, i.e. those the submission, the fixtures and the outputs
+// of the run go to. Under a read-only root filesystem each of them is a
+// volume, which unlike /tmp is kept until the outputs of the run have been
+// collected. The root is returned if any of them is in it.
+func workDirs(options SubmitOptions) []string {
+	candidates := writableDirs(options)
+	if options.Fixtures != nil {
+		candidates = append(candidates, path.Clean("/"+options.FixturesPath))
+		sort.Strings(candidates)
+	}
+	dirs := []string{}
+	for _, dir := range candidates {
+		if dir == "/" {
+			return []string{"/"}
+		}
+		nested := false
+		for _, parent := range dirs {
+			if isInDir(dir, parent) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// isInDir checks whether the clean absolute path `name` is `dir` or inside
+// it.
+func isInDir(name, dir string) bool {
+	return dir == "/" || name == dir || strings.HasPrefix(name, dir+"/")
+}
@@ -0,0 +1,184 @@
+package util
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// File is a regular file of an unpacked submission.
+type File struct {
+	// Name is the slash-separated path of the file, relative to the root
+	// of the archive.
+	Name string
+	Mode int64
+	Data []byte
+}
+
+// ErrNotArchive is returned by ExtractArchive for files it doesn't know how
+// to unpack.
+var ErrNotArchive = errors.New("not a zip or tar archive")
+
+// IsArchive checks whether `name` looks like an archive ExtractArchive can
+// unpack.
+func IsArchive(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtractArchive unpacks the zip, tar or gzipped tar archive `data` named
+// `name`. Only regular files are returned; directories are implied by file
+// names and anything else (e.g. symlinks) is rejected. Extraction stops
+// with an error once the files add up to more than `maxSize` bytes or there
+// are more than `maxFiles` of them, so that archive bombs don't exhaust the
+// server's memory.
+func ExtractArchive(name string, data []byte, maxSize int64, maxFiles int) ([]File, error) {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return extractZip(data, maxSize, maxFiles)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("corrupt archive: %v", err)
+		}
+		return extractTar(gz, maxSize, maxFiles)
+	case strings.HasSuffix(lower, ".tar"):
+		return extractTar(bytes.NewReader(data), maxSize, maxFiles)
+	}
+	return nil, ErrNotArchive
+}
+
+func extractZip(data []byte, maxSize int64, maxFiles int) ([]File, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("corrupt archive: %v", err)
+	}
+	e := extractor{maxSize: maxSize, maxFiles: maxFiles}
+	for _, f := range zr.File {
+		mode := f.Mode()
+		if mode.IsDir() {
+			continue
+		}
+		if !mode.IsRegular() {
+			return nil, fmt.Errorf("%v is not a regular file", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("corrupt archive: %v", err)
+		}
+		err = e.add(f.Name, int64(mode.Perm()), rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e.files, nil
+}
+
+func extractTar(r io.Reader, maxSize int64, maxFiles int) ([]File, error) {
+	tr := tar.NewReader(r)
+	e := extractor{maxSize: maxSize, maxFiles: maxFiles}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("corrupt archive: %v", err)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			return nil, fmt.Errorf("%v is not a regular file", header.Name)
+		}
+		if err := e.add(header.Name, header.Mode&0777, tr); err != nil {
+			return nil, err
+		}
+	}
+	return e.files, nil
+}
+
+// extractor collects files from an archive while enforcing limits.
+type extractor struct {
+	maxSize  int64
+	maxFiles int
+
+	size  int64
+	files []File
+	seen  map[string]bool
+}
+
+func (e *extractor) add(name string, mode int64, r io.Reader) error {
+	name = strings.Replace(name, "\\", "/", -1)
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("bad file name in archive: %q", name)
+	}
+	if e.seen == nil {
+		e.seen = map[string]bool{}
+	}
+	if e.seen[clean] {
+		return fmt.Errorf("duplicate file in archive: %v", clean)
+	}
+	e.seen[clean] = true
+
+	if len(e.files) >= e.maxFiles {
+		return fmt.Errorf("more than %d files in archive", e.maxFiles)
+	}
+	// read one byte more than allowed to detect oversized files
+	data, err := ioutil.ReadAll(io.LimitReader(r, e.maxSize-e.size+1))
+	if err != nil {
+		return fmt.Errorf("corrupt archive: %v", err)
+	}
+	e.size += int64(len(data))
+	if e.size > e.maxSize {
+		return fmt.Errorf("archive contents larger than %d bytes", e.maxSize)
+	}
+
+	if mode == 0 {
+		mode = 0644
+	}
+	e.files = append(e.files, File{clean, mode, data})
+	return nil
+}
+
+// MakeTarGz packs `files` into a gzipped tar archive.
+func MakeTarGz(files []File) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	gz := gzip.NewWriter(buffer)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name: f.Name,
+			Mode: f.Mode,
+			Size: int64(len(f.Data)),
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
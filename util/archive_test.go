@@ -0,0 +1,226 @@
+package util
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testEntry is a member of an archive built by the tests.
+type testEntry struct {
+	name    string
+	data    string
+	symlink bool
+}
+
+func makeZip(t *testing.T, entries []testEntry) []byte {
+	buffer := new(bytes.Buffer)
+	zw := zip.NewWriter(buffer)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name}
+		if e.symlink {
+			header.SetMode(0777 | os.ModeSymlink)
+		} else {
+			header.SetMode(0644)
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(e.data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func makeTar(t *testing.T, entries []testEntry) []byte {
+	buffer := new(bytes.Buffer)
+	tw := tar.NewWriter(buffer)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0755, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		if e.symlink {
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, e.data, 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if !e.symlink {
+			tw.Write([]byte(e.data))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestIsArchive(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"tema.zip", true},
+		{"TEMA.ZIP", true},
+		{"tema.tar", true},
+		{"tema.tar.gz", true},
+		{"tema.tgz", true},
+		{"tema.c", false},
+		{"tema.gz", false},
+		{"zip", false},
+	}
+	for _, test := range tests {
+		if got := IsArchive(test.name); got != test.want {
+			t.Errorf("IsArchive(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	tests := []struct {
+		desc     string
+		entries  []testEntry
+		maxSize  int64
+		maxFiles int
+		want     []string // names of the files, if no error is expected
+		wantErr  string
+	}{
+		{
+			desc:     "regular files",
+			entries:  []testEntry{{name: "Makefile", data: "all:"}, {name: "src/main.c", data: "int main;"}},
+			maxSize:  100,
+			maxFiles: 10,
+			want:     []string{"Makefile", "src/main.c"},
+		},
+		{
+			desc:     "names are cleaned",
+			entries:  []testEntry{{name: "./a/../b.c", data: "x"}, {name: `dir\c.c`, data: "y"}},
+			maxSize:  100,
+			maxFiles: 10,
+			want:     []string{"b.c", "dir/c.c"},
+		},
+		{
+			desc:     "limits reached exactly",
+			entries:  []testEntry{{name: "a", data: "12345"}, {name: "b", data: "67890"}},
+			maxSize:  10,
+			maxFiles: 2,
+			want:     []string{"a", "b"},
+		},
+		{
+			desc:     "too large",
+			entries:  []testEntry{{name: "a", data: "12345"}, {name: "b", data: "678901"}},
+			maxSize:  10,
+			maxFiles: 10,
+			wantErr:  "larger than 10 bytes",
+		},
+		{
+			desc:     "too many files",
+			entries:  []testEntry{{name: "a"}, {name: "b"}, {name: "c"}},
+			maxSize:  10,
+			maxFiles: 2,
+			wantErr:  "more than 2 files",
+		},
+		{
+			desc:     "absolute path",
+			entries:  []testEntry{{name: "/etc/passwd", data: "x"}},
+			maxSize:  10,
+			maxFiles: 10,
+			wantErr:  "bad file name",
+		},
+		{
+			desc:     "path escaping the archive",
+			entries:  []testEntry{{name: "a/../../evil", data: "x"}},
+			maxSize:  10,
+			maxFiles: 10,
+			wantErr:  "bad file name",
+		},
+		{
+			desc:     "duplicate file",
+			entries:  []testEntry{{name: "a.c", data: "x"}, {name: "./a.c", data: "y"}},
+			maxSize:  10,
+			maxFiles: 10,
+			wantErr:  "duplicate file",
+		},
+		{
+			desc:     "symlink",
+			entries:  []testEntry{{name: "link", data: "/etc/passwd", symlink: true}},
+			maxSize:  100,
+			maxFiles: 10,
+			wantErr:  "not a regular file",
+		},
+	}
+	formats := []struct {
+		name string
+		make func(*testing.T, []testEntry) []byte
+	}{
+		{"submission.zip", makeZip},
+		{"submission.tar", makeTar},
+	}
+	for _, format := range formats {
+		for _, test := range tests {
+			files, err := ExtractArchive(format.name, format.make(t, test.entries), test.maxSize, test.maxFiles)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("%v, %v: got error %v, want %q", format.name, test.desc, err, test.wantErr)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%v, %v: unexpected error %v", format.name, test.desc, err)
+				continue
+			}
+			names := []string{}
+			for _, f := range files {
+				names = append(names, f.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(test.want, ",") {
+				t.Errorf("%v, %v: got files %v, want %v", format.name, test.desc, names, test.want)
+			}
+		}
+	}
+}
+
+func TestExtractArchiveRejectsOtherFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"submission.c", []byte("int main;"), ErrNotArchive.Error()},
+		{"submission.zip", []byte("not a zip"), "corrupt archive"},
+		{"submission.tar.gz", []byte("not gzipped"), "corrupt archive"},
+	}
+	for _, test := range tests {
+		_, err := ExtractArchive(test.name, test.data, 100, 10)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("ExtractArchive(%q): got error %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestMakeTarGzRoundTrip(t *testing.T) {
+	files := []File{
+		{Name: "Dockerfile", Mode: 0644, Data: []byte("FROM alpine")},
+		{Name: "checker/run.sh", Mode: 0755, Data: []byte("#!/bin/sh")},
+	}
+	data, err := MakeTarGz(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ExtractArchive("context.tar.gz", data, 1000, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(files) {
+		t.Fatalf("got %d files, want %d", len(got), len(files))
+	}
+	for i, f := range files {
+		if got[i].Name != f.Name || got[i].Mode != f.Mode || string(got[i].Data) != string(f.Data) {
+			t.Errorf("file %d: got %+v, want %+v", i, got[i], f)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+	"github.com/AndreiDuma/lxchecker/util"
+)
+
+// parseArtifactSpecs parses the comma-separated lists of artifact paths
+// visible to students (`public`) and only to teachers (`private`).
+func parseArtifactSpecs(public, private string) ([]db.ArtifactSpec, error) {
+	specs := []db.ArtifactSpec{}
+	seen := map[string]bool{}
+	for _, list := range []struct {
+		value  string
+		public bool
+	}{{public, true}, {private, false}} {
+		for _, p := range strings.Split(list.value, ",") {
+			p = strings.TrimSpace(p)
+			if p == "" {
+				continue
+			}
+			if !path.IsAbs(p) {
+				return nil, fmt.Errorf("artifact path is not absolute: %q", p)
+			}
+			p = path.Clean(p)
+			if seen[p] {
+				return nil, fmt.Errorf("duplicate artifact path: %q", p)
+			}
+			seen[p] = true
+			specs = append(specs, db.ArtifactSpec{Path: p, Public: list.public})
+		}
+	}
+	return specs, nil
+}
+
+// artifactPaths returns the paths of the artifacts to collect for `a`.
+func artifactPaths(a *db.Assignment) []string {
+	paths := []string{}
+	for _, spec := range a.Artifacts {
+		paths = append(paths, spec.Path)
+	}
+	return paths
+}
+
+// storeArtifacts saves the artifacts collected for `s`. Those of a previous
+// run are kept in its history.
+func storeArtifacts(s *db.Submission, a *db.Assignment, artifacts []scheduler.Artifact) {
+	s.Artifacts = []db.Artifact{}
+	for _, artifact := range artifacts {
+		public := false
+		for _, spec := range a.Artifacts {
+			if spec.Path == artifact.Path {
+				public = spec.Public
+			}
+		}
+		s.Artifacts = append(s.Artifacts, db.Artifact{
+			Path:      artifact.Path,
+			FileId:    db.InsertFile(artifactFileName(artifact.Path, artifact.IsArchive), artifact.Data),
+			Size:      len(artifact.Data),
+			IsArchive: artifact.IsArchive,
+			Public:    public,
+		})
+	}
+}
+
+// artifactFileName is the name under which an artifact is downloaded.
+func artifactFileName(p string, isArchive bool) string {
+	name := path.Base(p)
+	if isArchive {
+		name += ".tar"
+	}
+	return name
+}
+
+// GetSubmissionArtifactHandler downloads an artifact of a submission, or of a
+// previous run of it. Private artifacts are only available to teachers.
+func GetSubmissionArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	rd := util.GetRequestData(r)
+	s := getSubmissionHelper(w, r)
+	if s == nil {
+		return
+	}
+	result := getResultHelper(w, r, s)
+	if result == nil {
+		return
+	}
+
+	i, err := strconv.Atoi(mux.Vars(r)["artifact_index"])
+	if err != nil || i < 0 || i >= len(result.Artifacts) {
+		http.Error(w, "no artifact matching given `artifact_index`", http.StatusNotFound)
+		return
+	}
+	artifact := result.Artifacts[i]
+	if !artifact.Public && !rd.UserIsTeacher && !rd.UserIsAdmin {
+		http.Error(w, "artifact is only available to teachers", http.StatusForbidden)
+		return
+	}
+
+	data, err := db.GetFile(artifact.FileId)
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "artifact contents no longer exist", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, artifactFileName(artifact.Path, artifact.IsArchive)))
+	w.Write(data)
+}
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AndreiDuma/lxchecker/db"
+)
+
+func TestParseArtifactSpecs(t *testing.T) {
+	tests := []struct {
+		public, private string
+		want            []db.ArtifactSpec
+		wantErr         string
+	}{
+		{want: []db.ArtifactSpec{}},
+		{
+			public:  "/submission/report.txt, /submission/coverage/",
+			private: "/lxchecker/debug.log",
+			want: []db.ArtifactSpec{
+				{Path: "/submission/report.txt", Public: true},
+				{Path: "/submission/coverage", Public: true},
+				{Path: "/lxchecker/debug.log", Public: false},
+			},
+		},
+		{public: "report.txt", wantErr: "not absolute"},
+		{public: "/a/report.txt", private: "/a/./report.txt", wantErr: "duplicate artifact path"},
+	}
+	for _, test := range tests {
+		got, err := parseArtifactSpecs(test.public, test.private)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("parseArtifactSpecs(%q, %q): got error %v, want %q", test.public, test.private, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseArtifactSpecs(%q, %q) = %+v, %v, want %+v", test.public, test.private, got, err, test.want)
+		}
+	}
+}
+
+func TestArtifactPaths(t *testing.T) {
+	a := &db.Assignment{Artifacts: []db.ArtifactSpec{
+		{Path: "/submission/report.txt", Public: true},
+		{Path: "/lxchecker/debug.log"},
+	}}
+	want := []string{"/submission/report.txt", "/lxchecker/debug.log"}
+	if got := artifactPaths(a); !reflect.DeepEqual(got, want) {
+		t.Errorf("artifactPaths() = %v, want %v", got, want)
+	}
+}
@@ -2,21 +2,28 @@ package web
 
 import (
 	"fmt"
-	"html/template"
+	"log"
 	"net/http"
+	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
 	"github.com/AndreiDuma/lxchecker/util"
+	"golang.org/x/net/context"
 )
 
+const megabyte = 1024 * 1024
+
 var (
 	validAssignmentId  = regexp.MustCompile(`[a-z]+[0-9a-z]+`)
+	validUlimitName    = regexp.MustCompile(`^[a-z]+$`)
 	deadlineDateFormat = "02.01.2006"
 
-	assignmentTmpl = template.Must(template.ParseFiles("templates/base.html", "templates/assignment.html"))
+	assignmentTmpl = newPage("assignment.html")
 )
 
 func CreateAssignmentHandler(w http.ResponseWriter, r *http.Request) {
@@ -38,6 +45,12 @@ func CreateAssignmentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	pullPolicy, err := scheduler.ParsePullPolicy(r.FormValue("pull_policy"))
+	if err != nil {
+		http.Error(w, "bad `pull_policy` field", http.StatusBadRequest)
+		return
+	}
+
 	timeoutInt, err := strconv.Atoi(r.FormValue("timeout"))
 	if err != nil {
 		http.Error(w, "bad or missing required `timeout` field", http.StatusBadRequest)
@@ -51,6 +64,108 @@ func CreateAssignmentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Get the rules uploads are checked against from request params.
+	unpack := r.FormValue("unpack") != ""
+	requiredFiles, err := parseFilePatterns(r.FormValue("required_files"))
+	if err != nil {
+		http.Error(w, "bad `required_files` field", http.StatusBadRequest)
+		return
+	}
+	forbiddenFiles, err := parseFilePatterns(r.FormValue("forbidden_files"))
+	if err != nil {
+		http.Error(w, "bad `forbidden_files` field", http.StatusBadRequest)
+		return
+	}
+	maxSubmissionSize, err := parseOptionalInt(r.FormValue("max_submission_size"))
+	if err != nil {
+		http.Error(w, "bad `max_submission_size` field", http.StatusBadRequest)
+		return
+	}
+	maxFileCount, err := parseOptionalInt(r.FormValue("max_file_count"))
+	if err != nil {
+		http.Error(w, "bad `max_file_count` field", http.StatusBadRequest)
+		return
+	}
+
+	maxLogSize, err := parseOptionalInt(r.FormValue("max_log_size"))
+	if err != nil {
+		http.Error(w, "bad `max_log_size` field", http.StatusBadRequest)
+		return
+	}
+
+	// Get resource limits from request params. They are all optional.
+	memoryLimit, err := parseOptionalInt(r.FormValue("memory_limit"))
+	if err != nil {
+		http.Error(w, "bad `memory_limit` field", http.StatusBadRequest)
+		return
+	}
+	cpuLimit, err := parseOptionalFloat(r.FormValue("cpu_limit"))
+	if err != nil {
+		http.Error(w, "bad `cpu_limit` field", http.StatusBadRequest)
+		return
+	}
+	pidsLimit, err := parseOptionalInt(r.FormValue("pids_limit"))
+	if err != nil {
+		http.Error(w, "bad `pids_limit` field", http.StatusBadRequest)
+		return
+	}
+	ulimits, err := parseUlimits(r.FormValue("ulimits"))
+	if err != nil {
+		http.Error(w, "bad `ulimits` field", http.StatusBadRequest)
+		return
+	}
+	tmpfsSize, err := parseOptionalInt(r.FormValue("tmpfs_size"))
+	if err != nil {
+		http.Error(w, "bad `tmpfs_size` field", http.StatusBadRequest)
+		return
+	}
+	diskSize, err := parseOptionalInt(r.FormValue("disk_size"))
+	if err != nil {
+		http.Error(w, "bad `disk_size` field", http.StatusBadRequest)
+		return
+	}
+
+	// Get the overrides of the hardened container confinement from request
+	// params. They are all optional.
+	user := strings.TrimSpace(r.FormValue("user"))
+	if user != "" && !validUser.MatchString(user) {
+		http.Error(w, "bad `user` field", http.StatusBadRequest)
+		return
+	}
+	capAdd, err := parseCapabilities(r.FormValue("cap_add"))
+	if err != nil {
+		http.Error(w, "bad `cap_add` field", http.StatusBadRequest)
+		return
+	}
+	writableRootfs := r.FormValue("writable_rootfs") != ""
+	seccompProfile, err := parseSeccompProfile(r.FormValue("seccomp_profile"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad `seccomp_profile` field: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Get the network to attach containers to from request params. Only
+	// networks allowed by the administrator may be used.
+	network := r.FormValue("network")
+	if network != "" && !isNetworkAllowed(network) {
+		http.Error(w, "`network` is not among the allowed networks", http.StatusBadRequest)
+		return
+	}
+
+	// Get the artifacts to collect after each run from request params.
+	artifacts, err := parseArtifactSpecs(r.FormValue("public_artifacts"), r.FormValue("private_artifacts"))
+	if err != nil {
+		http.Error(w, "bad `public_artifacts` or `private_artifacts` field", http.StatusBadRequest)
+		return
+	}
+
+	// Get the grading pipeline from request params, if any.
+	stages, err := parseStages(r.FormValue("stages"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad `stages` field: %v", err), http.StatusBadRequest)
+		return
+	}
+
 	// The deadlines are actually at the end of the day.
 	getEndOfDay := func(t time.Time) time.Time {
 		return t.Add(23*time.Hour + 59*time.Minute + 59*time.Second)
@@ -77,15 +192,39 @@ func CreateAssignmentHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Insert assignment in database.
 	a := db.Assignment{
-		Id:             assignmentId,
-		SubjectId:      rd.SubjectId,
-		Name:           name,
-		Image:          image,
-		Timeout:        timeout,
-		SubmissionPath: submissionPath,
-		SoftDeadline:   softDeadline,
-		HardDeadline:   hardDeadline,
-		DailyPenalty:   dailyPenalty,
+		Id:                assignmentId,
+		SubjectId:         rd.SubjectId,
+		Name:              name,
+		Image:             image,
+		PullPolicy:        string(pullPolicy),
+		Timeout:           timeout,
+		SubmissionPath:    submissionPath,
+		Unpack:            unpack,
+		RequiredFiles:     requiredFiles,
+		ForbiddenFiles:    forbiddenFiles,
+		MaxSubmissionSize: maxSubmissionSize * megabyte,
+		MaxFileCount:      int(maxFileCount),
+		MaxLogSize:        maxLogSize * megabyte,
+		MemoryLimit:       memoryLimit * megabyte,
+		CPULimit:          cpuLimit,
+		PidsLimit:         pidsLimit,
+		Ulimits:           ulimits,
+		TmpfsSize:         tmpfsSize * megabyte,
+		DiskSize:          diskSize * megabyte,
+		User:              user,
+		CapAdd:            capAdd,
+		WritableRootfs:    writableRootfs,
+		SeccompProfile:    seccompProfile,
+		Network:           network,
+		Artifacts:         artifacts,
+		Stages:            stages,
+		SoftDeadline:      softDeadline,
+		HardDeadline:      hardDeadline,
+		DailyPenalty:      dailyPenalty,
+	}
+	if err := checkWritablePaths(&a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	if err := db.InsertAssignment(a); err != nil {
 		if err == db.ErrNotFound {
@@ -99,10 +238,162 @@ func CreateAssignmentHandler(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
+	// Get the images ready before the first submission arrives.
+	go prePullImage(a.Image, pullPolicy)
+	for _, stage := range a.Stages {
+		if stage.Image != "" && stage.Image != a.Image {
+			go prePullImage(stage.Image, pullPolicy)
+		}
+	}
+
 	// Redirect to the newly created assignment.
 	http.Redirect(w, r, fmt.Sprintf("/-/%v/%v/", a.SubjectId, a.Id), http.StatusFound)
 }
 
+// UpdateAssignmentImageHandler changes the checker image of an assignment
+// and pulls it again.
+func UpdateAssignmentImageHandler(w http.ResponseWriter, r *http.Request) {
+	rd := util.GetRequestData(r)
+
+	a, err := db.GetAssignment(rd.SubjectId, rd.AssignmentId)
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "no assignment matching given `subject_id` and `assignment_id`", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+
+	// Get image and pull policy from request params.
+	a.Image = r.FormValue("image")
+	if a.Image == "" {
+		http.Error(w, "missing required `image` field", http.StatusBadRequest)
+		return
+	}
+	pullPolicy, err := scheduler.ParsePullPolicy(r.FormValue("pull_policy"))
+	if err != nil {
+		http.Error(w, "bad `pull_policy` field", http.StatusBadRequest)
+		return
+	}
+	a.PullPolicy = string(pullPolicy)
+
+	if err := db.UpdateAssignmentImage(a.SubjectId, a.Id, a.Image, a.PullPolicy); err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "no assignment matching given `subject_id` and `assignment_id`", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+
+	// The image may have been updated under the same name, so pull it
+	// regardless of the policy (unless pulling is forbidden).
+	if pullPolicy != scheduler.PullNever {
+		pullPolicy = scheduler.PullAlways
+	}
+	go prePullImage(a.Image, pullPolicy)
+
+	// Redirect back to the assignment.
+	http.Redirect(w, r, fmt.Sprintf("/-/%v/%v/", a.SubjectId, a.Id), http.StatusFound)
+}
+
+// prePullImage fetches `image` in advance so that submissions don't wait for
+// it. Failures are only logged, since submissions retry pulling anyway.
+func prePullImage(image string, policy scheduler.PullPolicy) {
+	defer util.LogPanics()
+
+	if policy == scheduler.PullNever {
+		return
+	}
+	digest, err := sched.Pull(context.Background(), image, policy)
+	if err != nil {
+		log.Printf("failed to pre-pull image %v: %v\n", image, err)
+		return
+	}
+	log.Printf("pre-pulled image %v (%v)\n", image, digest)
+}
+
+// isNetworkAllowed checks whether grading containers may be attached to
+// `network`. Allowed networks are listed, comma-separated, in the
+// LXCHECKER_NETWORKS environment variable.
+func isNetworkAllowed(network string) bool {
+	for _, allowed := range strings.Split(os.Getenv("LXCHECKER_NETWORKS"), ",") {
+		if strings.TrimSpace(allowed) == network {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOptionalInt parses a non-negative integer, treating a missing value as 0.
+func parseOptionalInt(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative value: %v", n)
+	}
+	return n, nil
+}
+
+// parseOptionalFloat parses a non-negative number, treating a missing value
+// as 0.
+func parseOptionalFloat(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if f < 0 {
+		return 0, fmt.Errorf("negative value: %v", f)
+	}
+	return f, nil
+}
+
+// parseUlimits parses a comma-separated list of ulimits such as
+// "nofile=1024:2048, nproc=64". A single value sets both the soft and the
+// hard limit.
+func parseUlimits(value string) ([]db.Ulimit, error) {
+	ulimits := []db.Ulimit{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		nameAndLimits := strings.SplitN(part, "=", 2)
+		if len(nameAndLimits) != 2 || !validUlimitName.MatchString(nameAndLimits[0]) {
+			return nil, fmt.Errorf("bad ulimit: %q", part)
+		}
+		limits := strings.SplitN(nameAndLimits[1], ":", 2)
+		soft, err := strconv.ParseInt(limits[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad ulimit: %q", part)
+		}
+		hard := soft
+		if len(limits) == 2 {
+			if hard, err = strconv.ParseInt(limits[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("bad ulimit: %q", part)
+			}
+		}
+		if soft > hard {
+			return nil, fmt.Errorf("soft limit greater than hard limit: %q", part)
+		}
+		ulimits = append(ulimits, db.Ulimit{
+			Name: nameAndLimits[0],
+			Soft: soft,
+			Hard: hard,
+		})
+	}
+	return ulimits, nil
+}
+
 func GetAssignmentHandler(w http.ResponseWriter, r *http.Request) {
 	rd := util.GetRequestData(r)
 
@@ -131,6 +422,8 @@ func GetAssignmentHandler(w http.ResponseWriter, r *http.Request) {
 		Submissions       []db.Submission
 		ActiveSubmissions []db.Submission
 		AllSubmissions    []db.Submission
+		Regrades          []db.Regrade
+		Builds            []db.Build
 	}
 	assignmentTmpl.Execute(w, &D{
 		rd,
@@ -139,5 +432,7 @@ func GetAssignmentHandler(w http.ResponseWriter, r *http.Request) {
 		db.GetSubmissionsOfUser(rd.SubjectId, rd.AssignmentId, rd.User.Username),
 		db.GetActiveSubmissions(rd.SubjectId, rd.AssignmentId),
 		db.GetAllSubmissions(rd.SubjectId, rd.AssignmentId),
+		db.GetRegrades(rd.SubjectId, rd.AssignmentId),
+		db.GetBuilds(rd.SubjectId, rd.AssignmentId),
 	})
 }
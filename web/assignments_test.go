@@ -0,0 +1,95 @@
+package web
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/AndreiDuma/lxchecker/db"
+)
+
+func TestParseUlimits(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []db.Ulimit
+		wantErr bool
+	}{
+		{value: "", want: []db.Ulimit{}},
+		{value: "nofile=1024", want: []db.Ulimit{{Name: "nofile", Soft: 1024, Hard: 1024}}},
+		{
+			value: " nofile=1024:2048, nproc=64 ,",
+			want:  []db.Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}, {Name: "nproc", Soft: 64, Hard: 64}},
+		},
+		{value: "nofile", wantErr: true},
+		{value: "nofile=lots", wantErr: true},
+		{value: "nofile=1:x", wantErr: true},
+		{value: "nofile=2048:1024", wantErr: true},
+		{value: "no file=1", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseUlimits(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseUlimits(%q): expected an error", test.value)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseUlimits(%q) = %+v, %v, want %+v", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestParseOptionalNumbers(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantInt   int64
+		wantFloat float64
+		wantErr   bool
+	}{
+		{value: ""},
+		{value: " 512 ", wantInt: 512, wantFloat: 512},
+		{value: "0", wantInt: 0, wantFloat: 0},
+		{value: "-1", wantErr: true},
+		{value: "lots", wantErr: true},
+	}
+	for _, test := range tests {
+		n, err := parseOptionalInt(test.value)
+		if (err != nil) != test.wantErr || n != test.wantInt {
+			t.Errorf("parseOptionalInt(%q) = %v, %v", test.value, n, err)
+		}
+		f, err := parseOptionalFloat(test.value)
+		if (err != nil) != test.wantErr || f != test.wantFloat {
+			t.Errorf("parseOptionalFloat(%q) = %v, %v", test.value, f, err)
+		}
+	}
+
+	// CPU limits may be fractional.
+	if f, err := parseOptionalFloat("0.5"); err != nil || f != 0.5 {
+		t.Errorf("parseOptionalFloat(\"0.5\") = %v, %v", f, err)
+	}
+	if _, err := parseOptionalInt("0.5"); err == nil {
+		t.Errorf("parseOptionalInt(\"0.5\"): expected an error")
+	}
+}
+
+func TestIsNetworkAllowed(t *testing.T) {
+	defer os.Setenv("LXCHECKER_NETWORKS", os.Getenv("LXCHECKER_NETWORKS"))
+	tests := []struct {
+		allowed string
+		network string
+		want    bool
+	}{
+		{"", "grading", false},
+		{"grading", "grading", true},
+		{"grading, mirrors ", "mirrors", true},
+		{"grading,mirrors", "bridge", false},
+		{"grading", "grad", false},
+	}
+	for _, test := range tests {
+		os.Setenv("LXCHECKER_NETWORKS", test.allowed)
+		if got := isNetworkAllowed(test.network); got != test.want {
+			t.Errorf("isNetworkAllowed(%q) with %q allowed = %v, want %v", test.network, test.allowed, got, test.want)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package web
 
 import (
-	"html/template"
 	"net/http"
 
 	"github.com/AndreiDuma/lxchecker/db"
@@ -9,8 +8,8 @@ import (
 )
 
 var (
-	loginTmpl  = template.Must(template.ParseFiles("templates/base.html", "templates/login.html"))
-	signupTmpl = template.Must(template.ParseFiles("templates/base.html", "templates/signup.html"))
+	loginTmpl  = newPage("login.html")
+	signupTmpl = newPage("signup.html")
 )
 
 // LoginTmplHandler serves the login page.
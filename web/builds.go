@@ -0,0 +1,280 @@
+package web
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+	"github.com/AndreiDuma/lxchecker/util"
+)
+
+var (
+	buildTmpl = newPage("build.html")
+
+	invalidTagChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+)
+
+// Limits applied to checker bundles and their builds.
+const (
+	maxBundleSize      = 256 * megabyte
+	maxBundleFileCount = 10000
+	maxBuildLogSize    = 1 * megabyte
+	buildTimeout       = 30 * time.Minute
+)
+
+// buildLogsFlushInterval is the minimum time between two saves of the logs of
+// a running build.
+const buildLogsFlushInterval = time.Second
+
+// buildTag is the tag of the image built for version `version` of the checker
+// of assignment `a`.
+func buildTag(a *db.Assignment, version int) string {
+	name := invalidTagChars.ReplaceAllString(strings.ToLower(a.SubjectId+"-"+a.Id), "-")
+	return fmt.Sprintf("lxchecker/%v:v%d", name, version)
+}
+
+// bundleContext turns the files of a checker bundle into a build context. A
+// bundle holds a Dockerfile and whatever it adds to the image (e.g. a checker
+// directory), either at its root or inside a single top-level directory.
+func bundleContext(files []util.File) ([]byte, error) {
+	prefix := ""
+	found := false
+	for _, f := range files {
+		if f.Name == "Dockerfile" {
+			prefix, found = "", true
+			break
+		}
+		if path.Base(f.Name) == "Dockerfile" && strings.Count(f.Name, "/") == 1 {
+			prefix, found = path.Dir(f.Name)+"/", true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no Dockerfile in bundle")
+	}
+
+	contextFiles := []util.File{}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name, prefix) {
+			continue
+		}
+		f.Name = strings.TrimPrefix(f.Name, prefix)
+		contextFiles = append(contextFiles, f)
+	}
+	return util.MakeTarGz(contextFiles)
+}
+
+// buildLogsWriter keeps the output of a build, saving it every now and then
+// so that the build can be followed.
+type buildLogsWriter struct {
+	mu        sync.Mutex
+	build     *db.Build
+	truncated bool
+	flushed   time.Time
+}
+
+func (w *buildLogsWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if room := maxBuildLogSize - len(w.build.Logs); len(p) > room {
+		if !w.truncated {
+			w.build.Logs = append(w.build.Logs, p[:room]...)
+			w.build.Logs = append(w.build.Logs, "\n[output truncated]\n"...)
+			w.truncated = true
+		}
+	} else {
+		w.build.Logs = append(w.build.Logs, p...)
+	}
+	if time.Since(w.flushed) >= buildLogsFlushInterval {
+		db.UpdateBuildLogs(w.build)
+		w.flushed = time.Now()
+	}
+	return len(p), nil
+}
+
+// BuildAssignmentImageHandler builds a new version of the checker image of an
+// assignment from an uploaded bundle. The build runs in the background and
+// the assignment switches to the image once it succeeds.
+func BuildAssignmentImageHandler(w http.ResponseWriter, r *http.Request) {
+	rd := util.GetRequestData(r)
+
+	a, err := db.GetAssignment(rd.SubjectId, rd.AssignmentId)
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "no assignment matching given `subject_id` and `assignment_id`", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+
+	// Get the bundle from request params.
+	if err := r.ParseMultipartForm(32 * megabyte); err != nil {
+		http.Error(w, "missing required `bundle` field", http.StatusBadRequest)
+		return
+	}
+	f, fileHeader, err := r.FormFile("bundle")
+	if err != nil {
+		http.Error(w, "missing required `bundle` field", http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		panic(err)
+	}
+	name := path.Base(fileHeader.Filename)
+	if !util.IsArchive(name) {
+		http.Error(w, "bundle must be a zip, tar or tar.gz archive", http.StatusBadRequest)
+		return
+	}
+	files, err := util.ExtractArchive(name, data, maxBundleSize, maxBundleFileCount)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid bundle: %v", err), http.StatusBadRequest)
+		return
+	}
+	buildContext, err := bundleContext(files)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid bundle: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Add the build to database, as the next version of the image.
+	b := &db.Build{
+		Id:             db.NewBuildId(),
+		SubjectId:      a.SubjectId,
+		AssignmentId:   a.Id,
+		RequestedBy:    rd.User.Username,
+		Timestamp:      time.Now(),
+		BundleFileId:   db.InsertFile(name, data),
+		BundleFileName: name,
+		Status:         db.BuildRunning,
+	}
+	if err := db.InsertBuild(b); err != nil {
+		panic(err)
+	}
+	b.Tag = buildTag(a, b.Version)
+	if err := db.UpdateBuild(b); err != nil {
+		panic(err)
+	}
+	go runBuild(b, buildContext)
+
+	// Redirect to the build, to follow it.
+	http.Redirect(w, r, fmt.Sprintf("/-/%v/%v/builds/%v", a.SubjectId, a.Id, b.Id), http.StatusFound)
+}
+
+// runBuild builds the image of `b` from `buildContext` and makes its
+// assignment use it, unless a later version was built meanwhile.
+func runBuild(b *db.Build, buildContext []byte) {
+	defer util.LogPanics()
+
+	ctx, cancel := context.WithTimeout(context.Background(), buildTimeout)
+	defer cancel()
+	logs := &buildLogsWriter{build: b}
+	digest, err := sched.Build(ctx, buildContext, b.Tag, logs)
+
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	b.FinishedAt = time.Now()
+	if err != nil {
+		b.Status = db.BuildFailed
+		b.Error = err.Error()
+		db.UpdateBuild(b)
+		return
+	}
+	b.Status = db.BuildDone
+	b.ImageDigest = digest
+	db.UpdateBuild(b)
+
+	// The image only exists on the Docker hosts, so it can't be pulled.
+	if err := db.UseBuild(b); err != nil {
+		log.Printf("build %v: assignment %v no longer exists or uses a later version\n", b.Id, b.AssignmentId)
+	}
+}
+
+// builtImages returns the images built for assignments and still used by
+// them, so that Docker hosts missing them can build them again from their
+// bundles.
+func builtImages() []scheduler.BuiltImage {
+	images := []scheduler.BuiltImage{}
+	for _, b := range db.GetBuildsInUse() {
+		b := b
+		images = append(images, scheduler.BuiltImage{
+			Tag: b.Tag,
+			Context: func() ([]byte, error) {
+				data, err := db.GetFile(b.BundleFileId)
+				if err != nil {
+					return nil, err
+				}
+				files, err := util.ExtractArchive(b.BundleFileName, data, maxBundleSize, maxBundleFileCount)
+				if err != nil {
+					return nil, err
+				}
+				return bundleContext(files)
+			},
+		})
+	}
+	return images
+}
+
+// GetBuildHandler shows the progress and logs of a build.
+func GetBuildHandler(w http.ResponseWriter, r *http.Request) {
+	rd := util.GetRequestData(r)
+
+	build, err := db.GetBuild(rd.SubjectId, rd.AssignmentId, mux.Vars(r)["build_id"])
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "no build matching given `subject_id`, `assignment_id` and `build_id`", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+
+	// Render template.
+	type D struct {
+		RequestData *util.RequestData
+
+		Subject    *db.Subject
+		Assignment *db.Assignment
+		Build      *db.Build
+	}
+	buildTmpl.Execute(w, &D{
+		rd,
+		db.GetSubjectOrPanic(rd.SubjectId),
+		db.GetAssignmentOrPanic(rd.SubjectId, rd.AssignmentId),
+		build,
+	})
+}
+
+// GetBuildBundleHandler downloads the bundle a build was made from.
+func GetBuildBundleHandler(w http.ResponseWriter, r *http.Request) {
+	rd := util.GetRequestData(r)
+
+	build, err := db.GetBuild(rd.SubjectId, rd.AssignmentId, mux.Vars(r)["build_id"])
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "no build matching given `subject_id`, `assignment_id` and `build_id`", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+	data, err := db.GetFile(build.BundleFileId)
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "bundle no longer exists", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, build.BundleFileName))
+	w.Write(data)
+}
@@ -0,0 +1,92 @@
+package web
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/util"
+)
+
+func TestBundleContext(t *testing.T) {
+	tests := []struct {
+		desc    string
+		files   []string
+		want    []string // files of the build context, if no error is expected
+		wantErr bool
+	}{
+		{
+			desc:  "Dockerfile at the root",
+			files: []string{"Dockerfile", "checker/run.sh"},
+			want:  []string{"Dockerfile", "checker/run.sh"},
+		},
+		{
+			desc:  "single top-level directory",
+			files: []string{"bundle/Dockerfile", "bundle/checker/run.sh", "README"},
+			want:  []string{"Dockerfile", "checker/run.sh"},
+		},
+		{
+			desc:  "the root wins over a directory",
+			files: []string{"bundle/Dockerfile", "Dockerfile", "run.sh"},
+			want:  []string{"bundle/Dockerfile", "Dockerfile", "run.sh"},
+		},
+		{
+			desc:    "Dockerfile too deep",
+			files:   []string{"a/b/Dockerfile"},
+			wantErr: true,
+		},
+		{
+			desc:    "no Dockerfile",
+			files:   []string{"checker/run.sh"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		files := []util.File{}
+		for _, name := range test.files {
+			files = append(files, util.File{Name: name, Mode: 0644, Data: []byte(name)})
+		}
+		data, err := bundleContext(files)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", test.desc, err)
+			continue
+		}
+		got, err := util.ExtractArchive("context.tar.gz", data, 1<<20, 100)
+		if err != nil {
+			t.Errorf("%v: bad build context: %v", test.desc, err)
+			continue
+		}
+		names := []string{}
+		for _, f := range got {
+			names = append(names, f.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%v: got files %v, want %v", test.desc, names, test.want)
+		}
+	}
+}
+
+func TestBuildTag(t *testing.T) {
+	tests := []struct {
+		subjectId, assignmentId string
+		version                 int
+		want                    string
+	}{
+		{"so", "tema3", 1, "lxchecker/so-tema3:v1"},
+		{"SO", "Tema 3", 12, "lxchecker/so-tema-3:v12"},
+		{"pc", "lab_1.2", 3, "lxchecker/pc-lab_1.2:v3"},
+		{"so", "tema/3:latest", 2, "lxchecker/so-tema-3-latest:v2"},
+	}
+	for _, test := range tests {
+		a := &db.Assignment{SubjectId: test.subjectId, Id: test.assignmentId}
+		if got := buildTag(a, test.version); got != test.want {
+			t.Errorf("buildTag(%q, %q, %d) = %q, want %q", test.subjectId, test.assignmentId, test.version, got, test.want)
+		}
+	}
+}
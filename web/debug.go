@@ -0,0 +1,183 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+	"github.com/AndreiDuma/lxchecker/util"
+)
+
+var (
+	debugTmpl = newPage("debug.html")
+
+	// debugSessions holds a token for each debug session open.
+	debugSessions = make(chan struct{}, maxDebugSessions)
+)
+
+// Limits applied to debug sessions.
+const (
+	debugSessionTimeout = 15 * time.Minute
+	maxDebugSessions    = 4
+)
+
+// debugMessage is sent by the browser's terminal: either keystrokes, or its
+// new size.
+type debugMessage struct {
+	Input string `json:"input"`
+	Cols  int    `json:"cols"`
+	Rows  int    `json:"rows"`
+}
+
+// lockedWriter serializes writes to an io.Writer.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// getDebugOptions describes the environment of `stageName` (the first stage
+// if empty) of submission `s`, in which debug shells are opened.
+func getDebugOptions(s *db.Submission, a *db.Assignment, stageName string) (scheduler.SubmitOptions, error) {
+	options, err := getSubmitOptions(s, a)
+	if err != nil {
+		return options, err
+	}
+	for _, stage := range getStages(a) {
+		if stageName == "" || stage.Name == stageName {
+			return getStageOptions(options, stage), nil
+		}
+	}
+	return options, fmt.Errorf("no stage named %q", stageName)
+}
+
+// DebugSubmissionHandler shows a terminal into the grading environment of a
+// submission.
+func DebugSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	s := getSubmissionHelper(w, r)
+	if s == nil {
+		return
+	}
+	a := db.GetAssignmentOrPanic(s.SubjectId, s.AssignmentId)
+
+	// Render template.
+	type D struct {
+		RequestData *util.RequestData
+
+		Subject    *db.Subject
+		Assignment *db.Assignment
+		Submission *db.Submission
+		Stages     []db.Stage
+		Stage      string
+		Timeout    time.Duration
+	}
+	debugTmpl.Execute(w, &D{
+		util.GetRequestData(r),
+		db.GetSubjectOrPanic(s.SubjectId),
+		a,
+		s,
+		getStages(a),
+		r.FormValue("stage"),
+		debugSessionTimeout,
+	})
+}
+
+// DebugSubmissionSocketHandler recreates the grading environment of a
+// submission, with the upload in place, and connects a shell inside it to the
+// browser's terminal over a websocket. The environment is destroyed when the
+// terminal disconnects, the shell exits or the session times out.
+func DebugSubmissionSocketHandler(w http.ResponseWriter, r *http.Request) {
+	rd := util.GetRequestData(r)
+	s := getSubmissionHelper(w, r)
+	if s == nil {
+		return
+	}
+	a := db.GetAssignmentOrPanic(s.SubjectId, s.AssignmentId)
+	options, err := getDebugOptions(s, a, r.FormValue("stage"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case debugSessions <- struct{}{}:
+		defer func() { <-debugSessions }()
+	default:
+		http.Error(w, "too many debug sessions, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	server := websocket.Server{
+		// Only allow pages of lxchecker to connect.
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			origin, err := websocket.Origin(config, r)
+			if err != nil || origin == nil || origin.Host != r.Host {
+				return fmt.Errorf("bad origin")
+			}
+			config.Origin = origin
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			ws.PayloadType = websocket.BinaryFrame
+			output := &lockedWriter{w: ws}
+			log.Printf("%v opened a debug shell into submission %v\n", rd.User.Username, s.Id)
+
+			ctx, cancel := context.WithTimeout(context.Background(), debugSessionTimeout)
+			defer cancel()
+
+			// Forward the terminal's messages until it disconnects.
+			input, inputWriter := io.Pipe()
+			resize := make(chan scheduler.TerminalSize, 1)
+			go func() {
+				defer cancel()
+				defer inputWriter.Close()
+				for {
+					message := debugMessage{}
+					if err := websocket.JSON.Receive(ws, &message); err != nil {
+						return
+					}
+					if message.Input != "" {
+						inputWriter.Write([]byte(message.Input))
+					}
+					if message.Cols > 0 && message.Rows > 0 {
+						select {
+						case resize <- scheduler.TerminalSize{Cols: message.Cols, Rows: message.Rows}:
+						default:
+						}
+					}
+				}
+			}()
+
+			err := sched.Debug(ctx, options, scheduler.DebugSession{
+				Input:  input,
+				Output: output,
+				Resize: resize,
+			})
+			input.Close()
+			switch {
+			case err == context.DeadlineExceeded:
+				fmt.Fprintf(output, "\r\n[time limit of %v exceeded]\r\n", debugSessionTimeout)
+			case err != nil && err != context.Canceled:
+				fmt.Fprintf(output, "\r\n[debug shell failed: %v]\r\n", err)
+			default:
+				fmt.Fprintf(output, "\r\n[session ended]\r\n")
+			}
+			log.Printf("%v closed the debug shell into submission %v\n", rd.User.Username, s.Id)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
@@ -0,0 +1,117 @@
+package web
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+	"github.com/AndreiDuma/lxchecker/util"
+)
+
+func TestGetDebugOptions(t *testing.T) {
+	archive, err := util.MakeTarGz([]util.File{{Name: "tema.c", Mode: 0644, Data: []byte("int main;")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages := []db.Stage{
+		{Name: "build", Command: "make", Timeout: 10 * time.Second},
+		{Name: "test", Image: "lxchecker/so-tema3-tests", Weight: 1},
+	}
+
+	tests := []struct {
+		desc        string
+		stages      []db.Stage
+		unpack      bool
+		upload      []byte
+		stage       string
+		wantImage   string
+		wantCommand string
+		wantTimeout time.Duration
+		wantFiles   int
+		wantErr     string
+		wantChecker bool // whether the error is the submission's fault
+	}{
+		{
+			desc:        "single stage",
+			upload:      []byte("submission"),
+			wantImage:   "lxchecker/so-tema3",
+			wantTimeout: time.Minute,
+		},
+		{
+			desc:        "first stage by default",
+			stages:      stages,
+			upload:      []byte("submission"),
+			wantImage:   "lxchecker/so-tema3",
+			wantCommand: "make",
+			wantTimeout: 10 * time.Second,
+		},
+		{
+			desc:        "named stage",
+			stages:      stages,
+			upload:      []byte("submission"),
+			stage:       "test",
+			wantImage:   "lxchecker/so-tema3-tests",
+			wantTimeout: time.Minute,
+		},
+		{
+			desc:    "unknown stage",
+			stages:  stages,
+			upload:  []byte("submission"),
+			stage:   "style",
+			wantErr: `no stage named "style"`,
+		},
+		{
+			desc:        "unpacked upload",
+			unpack:      true,
+			upload:      archive,
+			wantImage:   "lxchecker/so-tema3",
+			wantTimeout: time.Minute,
+			wantFiles:   1,
+		},
+		{
+			desc:        "corrupt upload",
+			unpack:      true,
+			upload:      []byte("not gzipped"),
+			wantErr:     "invalid submission",
+			wantChecker: true,
+		},
+	}
+	for _, test := range tests {
+		a := &db.Assignment{
+			Image:          "lxchecker/so-tema3",
+			Timeout:        time.Minute,
+			SubmissionPath: "/submission/submission.tar.gz",
+			Unpack:         test.unpack,
+			Stages:         test.stages,
+			Ulimits:        []db.Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}},
+			User:           "root",
+		}
+		s := &db.Submission{UploadedFile: test.upload, UploadedFileName: "submission.tar.gz"}
+		options, err := getDebugOptions(s, a, test.stage)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%v: got error %v, want %q", test.desc, err, test.wantErr)
+			}
+			if _, ok := err.(scheduler.CheckerError); ok != test.wantChecker {
+				t.Errorf("%v: got error %#v, checker error %v", test.desc, err, test.wantChecker)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", test.desc, err)
+			continue
+		}
+		if options.Image != test.wantImage || options.Command != test.wantCommand || options.Timeout != test.wantTimeout {
+			t.Errorf("%v: got image %q, command %q and timeout %v, want %q, %q and %v", test.desc, options.Image, options.Command, options.Timeout, test.wantImage, test.wantCommand, test.wantTimeout)
+		}
+		if len(options.SubmissionFiles) != test.wantFiles || string(options.Submission) != string(test.upload) {
+			t.Errorf("%v: got %d unpacked files and upload %q", test.desc, len(options.SubmissionFiles), options.Submission)
+		}
+		// The shell runs in the same environment as the checker.
+		if options.Security.User != "root" || len(options.Resources.Ulimits) != 1 || options.Resources.Ulimits[0] != (scheduler.Ulimit{Name: "nofile", Soft: 1024, Hard: 2048}) {
+			t.Errorf("%v: got security %+v and resources %+v", test.desc, options.Security, options.Resources)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/util"
+)
+
+// logsFlushInterval is how often the logs of running submissions are saved,
+// and therefore how often they are pushed to the submission page.
+const logsFlushInterval = time.Second
+
+// liveLogsWriter collects the output of a running submission and
+// periodically saves it in the database, so that it can be followed live.
+type liveLogsWriter struct {
+	s *db.Submission
+
+	mu    sync.Mutex
+	logs  bytes.Buffer
+	run   int // saved as the LogsRun of the submission
+	dirty bool
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newLiveLogsWriter(s *db.Submission) *liveLogsWriter {
+	w := &liveLogsWriter{
+		s:       s,
+		run:     s.LogsRun + 1,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.flushPeriodically()
+	return w
+}
+
+func (w *liveLogsWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dirty = true
+	return w.logs.Write(p)
+}
+
+// Truncate drops the logs collected after the first `n` bytes, starting a
+// new run of the logs.
+func (w *liveLogsWriter) Truncate(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dirty = true
+	w.run++
+	w.logs.Truncate(n)
+}
+
+// Run returns the run of the logs collected so far.
+func (w *liveLogsWriter) Run() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.run
+}
+
+// Bytes returns the logs collected so far.
+func (w *liveLogsWriter) Bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]byte(nil), w.logs.Bytes()...)
+}
+
+// Close stops saving the logs, so that they don't overwrite the final ones
+// saved along with the results of the submission.
+func (w *liveLogsWriter) Close() error {
+	close(w.done)
+	<-w.stopped
+	return nil
+}
+
+func (w *liveLogsWriter) flushPeriodically() {
+	defer close(w.stopped)
+	defer util.LogPanics()
+
+	ticker := time.NewTicker(logsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+func (w *liveLogsWriter) flush() {
+	w.mu.Lock()
+	if !w.dirty {
+		w.mu.Unlock()
+		return
+	}
+	// Only copy the ids, the rest of the submission changes while it runs.
+	s := db.Submission{
+		Id:           w.s.Id,
+		SubjectId:    w.s.SubjectId,
+		AssignmentId: w.s.AssignmentId,
+		Logs:         append([]byte(nil), inlineLog(w.logs.Bytes())...),
+		LogsRun:      w.run,
+	}
+	w.dirty = false
+	w.mu.Unlock()
+
+	db.UpdateSubmissionLogs(&s)
+}
+
+// submissionEventsPollInterval is how often the version of the submission is
+// checked by GetSubmissionEventsHandler, its progress being fetched only once
+// the version changes.
+const submissionEventsPollInterval = time.Second
+
+// GetSubmissionEventsHandler streams the logs of a running submission as
+// Server-Sent Events. A "logs" event carries new output as a JSON string, a
+// "stages" event the statuses of the pipeline's stages, a "reset" event
+// means the output starts over and a final "status" event carries the
+// status the submission ended in.
+func GetSubmissionEventsHandler(w http.ResponseWriter, r *http.Request) {
+	s := getSubmissionHelper(w, r)
+	if s == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	sendEvent := func(event string, data interface{}) {
+		encoded, _ := json.Marshal(data)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, encoded)
+		flusher.Flush()
+	}
+
+	sent, sentRun := 0, s.LogsRun
+	sentStages := ""
+	sentStatus := db.Status("")
+	for {
+		if len(s.Logs) > sent {
+			sendEvent("logs", string(s.Logs[sent:]))
+			sent = len(s.Logs)
+		}
+		statuses := []db.Status{}
+		for _, stage := range s.Stages {
+			statuses = append(statuses, stage.Status)
+		}
+		if encoded, _ := json.Marshal(statuses); string(encoded) != sentStages {
+			sendEvent("stages", statuses)
+			sentStages = string(encoded)
+		}
+		if s.Status != sentStatus {
+			sendEvent("status", s.Status)
+			sentStatus = s.Status
+		}
+		if s.Status.IsFinished() {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(submissionEventsPollInterval):
+		}
+
+		version, err := db.GetSubmissionVersion(s.SubjectId, s.AssignmentId, s.Id)
+		if err != nil {
+			if err == db.ErrNotFound {
+				return
+			}
+			panic(err)
+		}
+		if version == s.Version {
+			continue
+		}
+		if s, err = db.GetSubmissionProgress(s.SubjectId, s.AssignmentId, s.Id); err != nil {
+			if err == db.ErrNotFound {
+				return
+			}
+			panic(err)
+		}
+		if s.LogsRun != sentRun {
+			// The submission or one of its stages is being run
+			// again, start over.
+			sendEvent("reset", nil)
+			sent, sentRun = 0, s.LogsRun
+		}
+	}
+}
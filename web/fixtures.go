@@ -0,0 +1,138 @@
+package web
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/util"
+)
+
+// Limits applied to test fixture archives.
+const (
+	maxFixturesSize      = 256 * megabyte
+	maxFixturesFileCount = 10000
+)
+
+// defaultFixturesPath is where fixtures are unpacked unless told otherwise.
+const defaultFixturesPath = "/fixtures"
+
+// getFixtures returns the unpacked test fixtures of `a`, if it has any.
+func getFixtures(a *db.Assignment) ([]util.File, error) {
+	if a.FixturesFileId == "" {
+		return nil, nil
+	}
+	data, err := db.GetFile(a.FixturesFileId)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return nil, fmt.Errorf("test fixtures no longer exist")
+		}
+		panic(err)
+	}
+	return util.ExtractArchive(a.FixturesFileName, data, maxFixturesSize, maxFixturesFileCount)
+}
+
+// UpdateAssignmentFixturesHandler replaces or removes the test fixtures of an
+// assignment.
+func UpdateAssignmentFixturesHandler(w http.ResponseWriter, r *http.Request) {
+	rd := util.GetRequestData(r)
+
+	a, err := db.GetAssignment(rd.SubjectId, rd.AssignmentId)
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "no assignment matching given `subject_id` and `assignment_id`", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+	if err := r.ParseMultipartForm(32 * megabyte); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	oldFileId := a.FixturesFileId
+
+	if r.FormValue("remove") != "" {
+		a.FixturesFileId, a.FixturesFileName, a.FixturesPath = "", "", ""
+	} else {
+		// Get the fixtures path and archive from request params.
+		fixturesPath := strings.TrimSpace(r.FormValue("fixtures_path"))
+		if fixturesPath == "" {
+			fixturesPath = defaultFixturesPath
+		}
+		if !path.IsAbs(fixturesPath) || path.Clean(fixturesPath) == "/" {
+			http.Error(w, "bad `fixtures_path` field", http.StatusBadRequest)
+			return
+		}
+		a.FixturesPath = path.Clean(fixturesPath)
+
+		f, fileHeader, err := r.FormFile("fixtures")
+		if err != nil {
+			http.Error(w, "missing required `fixtures` field", http.StatusBadRequest)
+			return
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+		name := path.Base(fileHeader.Filename)
+		if !util.IsArchive(name) {
+			http.Error(w, "fixtures must be a zip, tar or tar.gz archive", http.StatusBadRequest)
+			return
+		}
+		if _, err := util.ExtractArchive(name, data, maxFixturesSize, maxFixturesFileCount); err != nil {
+			http.Error(w, fmt.Sprintf("invalid fixtures: %v", err), http.StatusBadRequest)
+			return
+		}
+		a.FixturesFileId = db.InsertFile(name, data)
+		a.FixturesFileName = name
+	}
+
+	if err := db.UpdateAssignmentFixtures(a); err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "no assignment matching given `subject_id` and `assignment_id`", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+	if oldFileId != "" {
+		if err := db.RemoveFile(oldFileId); err != nil {
+			log.Printf("failed to remove fixtures %v of assignment %v: %v\n", oldFileId, a.Id, err)
+		}
+	}
+
+	// Redirect back to the assignment.
+	http.Redirect(w, r, fmt.Sprintf("/-/%v/%v/", a.SubjectId, a.Id), http.StatusFound)
+}
+
+// GetAssignmentFixturesHandler downloads the test fixtures of an assignment.
+func GetAssignmentFixturesHandler(w http.ResponseWriter, r *http.Request) {
+	rd := util.GetRequestData(r)
+
+	a, err := db.GetAssignment(rd.SubjectId, rd.AssignmentId)
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "no assignment matching given `subject_id` and `assignment_id`", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+	if a.FixturesFileId == "" {
+		http.Error(w, "assignment has no test fixtures", http.StatusNotFound)
+		return
+	}
+	data, err := db.GetFile(a.FixturesFileId)
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "test fixtures no longer exist", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, a.FixturesFileName))
+	w.Write(data)
+}
@@ -1,7 +1,6 @@
 package web
 
 import (
-	"html/template"
 	"net/http"
 
 	"github.com/AndreiDuma/lxchecker/db"
@@ -9,7 +8,7 @@ import (
 )
 
 var (
-	indexTmpl = template.Must(template.ParseFiles("templates/base.html", "templates/index.html"))
+	indexTmpl = newPage("index.html")
 )
 
 func LandingHandler(w http.ResponseWriter, r *http.Request) {
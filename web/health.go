@@ -0,0 +1,18 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HealthHandler reports whether submissions can be run, as JSON, for load
+// balancers and monitoring. It responds with 503 Service Unavailable if the
+// executor is unhealthy. Submissions made meanwhile wait in the queue.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	health := sched.Health()
+	w.Header().Set("Content-Type", "application/json")
+	if !health.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,79 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/AndreiDuma/lxchecker/db"
+)
+
+// maxInlineLogSize bounds the logs kept inside submission documents, so that
+// they stay well below MongoDB's document size limit. Larger logs are stored
+// as files.
+const maxInlineLogSize = 256 * 1024
+
+// inlineLog returns the part of `data` kept inside a document.
+func inlineLog(data []byte) []byte {
+	if len(data) <= maxInlineLogSize {
+		return data
+	}
+	inline := append([]byte(nil), data[:maxInlineLogSize]...)
+	return append(inline, fmt.Sprintf("\n[only the first %d bytes are shown, download the logs to see the rest]\n", maxInlineLogSize)...)
+}
+
+// storeLog saves `data` as the log `name` of submission `s`, in a file if
+// it's too large for the document.
+func storeLog(s *db.Submission, name string, data []byte) (inline []byte, fileId string) {
+	if len(data) > maxInlineLogSize {
+		fileId = db.InsertFile(fmt.Sprintf("%v-%v.log", s.Id, name), data)
+	}
+	return inlineLog(data), fileId
+}
+
+// GetSubmissionLogsHandler downloads the full logs of a submission, or of a
+// previous run of it: the interleaved "logs", "stdout" or "stderr".
+func GetSubmissionLogsHandler(w http.ResponseWriter, r *http.Request) {
+	s := getSubmissionHelper(w, r)
+	if s == nil {
+		return
+	}
+	result := getResultHelper(w, r, s)
+	if result == nil {
+		return
+	}
+
+	name := mux.Vars(r)["stream"]
+	var data []byte
+	var fileId string
+	switch name {
+	case "logs":
+		data, fileId = s.Logs, result.LogsFileId
+	case "stdout":
+		data, fileId = s.Stdout, result.StdoutFileId
+	case "stderr":
+		data, fileId = s.Stderr, result.StderrFileId
+	default:
+		http.Error(w, "`stream` must be one of logs, stdout or stderr", http.StatusNotFound)
+		return
+	}
+	if _, ok := mux.Vars(r)["history_index"]; ok {
+		// The logs of previous runs are all in files.
+		data = nil
+	}
+	if fileId != "" {
+		var err error
+		if data, err = db.GetFile(fileId); err != nil {
+			if err == db.ErrNotFound {
+				http.Error(w, "logs no longer exist", http.StatusNotFound)
+				return
+			}
+			panic(err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v-%v.log"`, s.Id, name))
+	w.Write(data)
+}
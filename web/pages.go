@@ -0,0 +1,48 @@
+package web
+
+import (
+	"html/template"
+	"io"
+	"sync"
+)
+
+// page is the template of a page, made of templates/base.html and its own
+// file. Templates are parsed on first use, or by parsePages when the server
+// starts, so that the command-line tools don't need them.
+type page struct {
+	name string
+
+	once sync.Once
+	tmpl *template.Template
+}
+
+// pages holds all pages created by newPage.
+var pages = []*page{}
+
+// newPage creates the page whose template is templates/`name`.
+func newPage(name string) *page {
+	p := &page{name: name}
+	pages = append(pages, p)
+	return p
+}
+
+// parse parses the templates of the page, panicking if they're malformed.
+func (p *page) parse() {
+	p.once.Do(func() {
+		p.tmpl = template.Must(template.ParseFiles("templates/base.html", "templates/"+p.name))
+	})
+}
+
+// Execute renders the page with `data`.
+func (p *page) Execute(w io.Writer, data interface{}) error {
+	p.parse()
+	return p.tmpl.Execute(w, data)
+}
+
+// parsePages parses the templates of all pages, so that malformed ones are
+// found right away.
+func parsePages() {
+	for _, p := range pages {
+		p.parse()
+	}
+}
@@ -0,0 +1,169 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/util"
+)
+
+var (
+	regradeTmpl = newPage("regrade.html")
+)
+
+// RegradeAssignmentHandler runs the active submissions of an assignment, or
+// all of them if `scope` is "all", again with the current checker. Previous
+// results are kept as history.
+func RegradeAssignmentHandler(w http.ResponseWriter, r *http.Request) {
+	rd := util.GetRequestData(r)
+
+	a, err := db.GetAssignment(rd.SubjectId, rd.AssignmentId)
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "no assignment matching given `subject_id` and `assignment_id`", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+
+	regrade := &db.Regrade{
+		Id:             db.NewRegradeId(),
+		SubjectId:      a.SubjectId,
+		AssignmentId:   a.Id,
+		RequestedBy:    rd.User.Username,
+		Timestamp:      time.Now(),
+		AllSubmissions: r.FormValue("scope") == "all",
+		SubmissionIds:  []string{},
+	}
+	var submissions []db.Submission
+	if regrade.AllSubmissions {
+		submissions = db.GetAllSubmissions(a.SubjectId, a.Id)
+	} else {
+		submissions = db.GetActiveSubmissions(a.SubjectId, a.Id)
+	}
+
+	// Reset the submissions, skipping those still waiting for their
+	// results.
+	reset := []*db.Submission{}
+	for i := range submissions {
+		s := &submissions[i]
+		if !s.Status.IsFinished() {
+			continue
+		}
+		if err := db.ResetSubmissionForRegrade(s, regrade.Id); err != nil {
+			if err == db.ErrNotFound {
+				continue
+			}
+			panic(err)
+		}
+		regrade.SubmissionIds = append(regrade.SubmissionIds, s.Id)
+		reset = append(reset, s)
+	}
+	if err := db.InsertRegrade(regrade); err != nil {
+		panic(err)
+	}
+
+	// Queue them behind the submissions of students.
+	for _, s := range reset {
+		if err := pool.Enqueue(s, db.JobPriorityBulk); err != nil {
+			panic(err)
+		}
+	}
+
+	// Redirect to the progress of the regrade.
+	http.Redirect(w, r, fmt.Sprintf("/-/%v/%v/regrades/%v", a.SubjectId, a.Id, regrade.Id), http.StatusFound)
+}
+
+// regradeChange compares the results of a submission before and after a
+// regrade.
+type regradeChange struct {
+	Submission *db.Submission
+	Old        db.PastResult
+	NewStatus  db.Status
+	NewScore   int
+	Done       bool
+	Diff       int
+}
+
+// getRegradeChange finds the results of `s` before and after `regrade`,
+// which may have been followed by other regrades.
+func getRegradeChange(s *db.Submission, regrade *db.Regrade) regradeChange {
+	change := regradeChange{
+		Submission: s,
+		NewStatus:  s.Status,
+		NewScore:   s.ScoreByTests,
+	}
+	for i, past := range s.History {
+		if past.RegradeId != regrade.Id {
+			continue
+		}
+		change.Old = past
+		if i+1 < len(s.History) {
+			change.NewStatus = s.History[i+1].Status
+			change.NewScore = s.History[i+1].ScoreByTests
+		}
+	}
+	change.Done = change.NewStatus.IsFinished()
+	change.Diff = change.NewScore - change.Old.ScoreByTests
+	return change
+}
+
+// GetRegradeHandler shows the progress of a regrade and how scores changed.
+func GetRegradeHandler(w http.ResponseWriter, r *http.Request) {
+	rd := util.GetRequestData(r)
+
+	regrade, err := db.GetRegrade(rd.SubjectId, rd.AssignmentId, mux.Vars(r)["regrade_id"])
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "no regrade matching given `subject_id`, `assignment_id` and `regrade_id`", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
+
+	changes := []regradeChange{}
+	pending, improved, worsened, unchanged := 0, 0, 0, 0
+	submissions := db.GetRegradedSubmissions(regrade.SubjectId, regrade.AssignmentId, regrade.SubmissionIds)
+	for i := range submissions {
+		change := getRegradeChange(&submissions[i], regrade)
+		switch {
+		case !change.Done:
+			pending++
+		case change.Diff > 0:
+			improved++
+		case change.Diff < 0:
+			worsened++
+		default:
+			unchanged++
+		}
+		changes = append(changes, change)
+	}
+
+	// Render template.
+	type D struct {
+		RequestData *util.RequestData
+		Subject     *db.Subject
+		Assignment  *db.Assignment
+		Regrade     *db.Regrade
+		Changes     []regradeChange
+		Pending     int
+		Improved    int
+		Worsened    int
+		Unchanged   int
+	}
+	regradeTmpl.Execute(w, &D{
+		rd,
+		db.GetSubjectOrPanic(regrade.SubjectId),
+		db.GetAssignmentOrPanic(regrade.SubjectId, regrade.AssignmentId),
+		regrade,
+		changes,
+		pending,
+		improved,
+		worsened,
+		unchanged,
+	})
+}
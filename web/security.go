@@ -0,0 +1,98 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+)
+
+var (
+	validUser       = regexp.MustCompile(`^([a-z_][a-z0-9_-]*|[0-9]+)(:([a-z_][a-z0-9_-]*|[0-9]+))?$`)
+	knownCapability = map[string]bool{
+		"AUDIT_CONTROL": true, "AUDIT_READ": true, "AUDIT_WRITE": true,
+		"BLOCK_SUSPEND": true, "CHOWN": true, "DAC_OVERRIDE": true,
+		"DAC_READ_SEARCH": true, "FOWNER": true, "FSETID": true,
+		"IPC_LOCK": true, "IPC_OWNER": true, "KILL": true, "LEASE": true,
+		"LINUX_IMMUTABLE": true, "MAC_ADMIN": true, "MAC_OVERRIDE": true,
+		"MKNOD": true, "NET_ADMIN": true, "NET_BIND_SERVICE": true,
+		"NET_BROADCAST": true, "NET_RAW": true, "SETFCAP": true,
+		"SETGID": true, "SETPCAP": true, "SETUID": true, "SYS_ADMIN": true,
+		"SYS_BOOT": true, "SYS_CHROOT": true, "SYS_MODULE": true,
+		"SYS_NICE": true, "SYS_PACCT": true, "SYS_PTRACE": true,
+		"SYS_RAWIO": true, "SYS_RESOURCE": true, "SYS_TIME": true,
+		"SYS_TTY_CONFIG": true, "SYSLOG": true, "WAKE_ALARM": true,
+	}
+)
+
+// parseCapabilities parses a comma-separated list of capabilities such as
+// "SYS_PTRACE, CAP_NET_RAW". The "CAP_" prefix is optional.
+func parseCapabilities(value string) ([]string, error) {
+	caps := []string{}
+	for _, c := range strings.Split(value, ",") {
+		c = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(c)), "CAP_")
+		if c == "" {
+			continue
+		}
+		if !knownCapability[c] {
+			return nil, fmt.Errorf("unknown capability: %q", c)
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+// parseSeccompProfile checks that `value` is empty, "unconfined" or a JSON
+// seccomp profile.
+func parseSeccompProfile(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == scheduler.SeccompUnconfined {
+		return value, nil
+	}
+	profile := struct {
+		DefaultAction string `json:"defaultAction"`
+	}{}
+	if err := json.Unmarshal([]byte(value), &profile); err != nil {
+		return "", err
+	}
+	if profile.DefaultAction == "" {
+		return "", fmt.Errorf("missing `defaultAction`")
+	}
+	return value, nil
+}
+
+// checkWritablePaths makes sure that everything the checkers of `a` write to
+// is inside a directory that can be made writable, unless the whole root
+// filesystem is.
+func checkWritablePaths(a *db.Assignment) error {
+	if a.WritableRootfs {
+		return nil
+	}
+	submissionDir := path.Clean("/" + a.SubmissionPath)
+	if !a.Unpack {
+		submissionDir = path.Dir(submissionDir)
+	}
+	if submissionDir == "/" {
+		return fmt.Errorf("the submission must be inside a directory, since the root filesystem is read-only")
+	}
+	for _, spec := range a.Artifacts {
+		if path.Dir(spec.Path) == "/" {
+			return fmt.Errorf("artifact %v must be inside a directory, since the root filesystem is read-only", spec.Path)
+		}
+	}
+	return nil
+}
+
+// getSecurity returns the confinement of the checkers of `a`.
+func getSecurity(a *db.Assignment) scheduler.Security {
+	return scheduler.Security{
+		User:           a.User,
+		CapAdd:         a.CapAdd,
+		WritableRootfs: a.WritableRootfs,
+		SeccompProfile: a.SeccompProfile,
+	}
+}
@@ -0,0 +1,141 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/AndreiDuma/lxchecker/checker"
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+)
+
+// getStages returns the grading pipeline of `a`. Assignments without stages
+// run their image once.
+func getStages(a *db.Assignment) []db.Stage {
+	if len(a.Stages) > 0 {
+		return a.Stages
+	}
+	return []db.Stage{{Name: "test", Weight: 1}}
+}
+
+// getStageOptions adapts the options of a submission to `stage`.
+func getStageOptions(options scheduler.SubmitOptions, stage db.Stage) scheduler.SubmitOptions {
+	if stage.Image != "" {
+		options.Image = stage.Image
+	}
+	if stage.Timeout > 0 {
+		options.Timeout = stage.Timeout
+	}
+	options.Command = stage.Command
+	return options
+}
+
+// runStage runs `stage` of a submission described by `options`, appending
+// its logs to `logs`, and records its outcome in `result`. Only the last
+// stage has to report a score.
+func runStage(ctx context.Context, result *db.StageResult, stage db.Stage, options scheduler.SubmitOptions, logs *liveLogsWriter, last bool) scheduler.SubmitResponse {
+	start := len(logs.Bytes())
+	stageOptions := getStageOptions(options, stage)
+	stageOptions.Output = logs
+	stageOptions.Retrying = func(err error) {
+		// Start the stage's logs over.
+		logs.Truncate(start)
+		fmt.Fprintf(logs, "[infrastructure error, running again: %v]\n", err)
+		start = len(logs.Bytes())
+	}
+	response, err := sched.Submit(ctx, stageOptions)
+
+	stageLogs := logs.Bytes()[start:]
+	evaluateStage(result, stage, response, stageLogs, err, !last)
+	result.Logs = inlineLog(stageLogs)
+	return response
+}
+
+// evaluateStage records the outcome of running `stage`, which produced
+// `logs`, as evaluated by checker.Evaluate. Stages that time out keep the
+// score reported before the checker was killed; other failed stages get no
+// points. Stages before the last one don't have to report a score.
+func evaluateStage(result *db.StageResult, stage db.Stage, response scheduler.SubmitResponse, logs []byte, err error, scoreOptional bool) {
+	result.Metrics = db.Metrics{
+		WallTime:   response.Metrics.WallTime,
+		CPUTime:    response.Metrics.CPUTime,
+		PeakMemory: response.Metrics.PeakMemory,
+		OOMKilled:  response.Metrics.OOMKilled,
+	}
+	outcome := checker.Evaluate(response, logs, err, scoreOptional)
+	result.Status = outcome.Status
+	result.Error = outcome.Error
+	if err != nil {
+		return
+	}
+	result.ImageDigest = response.ImageDigest
+	result.Metadata = outcome.Metadata
+	result.Tests = outcome.Tests
+	result.Score = outcome.Score
+	result.Points = int(math.Floor(float64(outcome.Score)*stage.Weight + 0.5))
+	if outcome.Status != db.StatusDone && outcome.Status != db.StatusTimedOut {
+		result.Points = 0
+	}
+}
+
+// stageSpec is the format in which teachers describe a stage, e.g.
+//
+//	{"name": "build", "command": "make", "timeout": 60, "weight": 0, "stop_on_failure": true}
+//
+// The timeout is in seconds and the weight defaults to 1.
+type stageSpec struct {
+	Name          string   `json:"name"`
+	Image         string   `json:"image"`
+	Command       string   `json:"command"`
+	Timeout       int      `json:"timeout"`
+	Weight        *float64 `json:"weight"`
+	StopOnFailure bool     `json:"stop_on_failure"`
+}
+
+// parseStages parses a JSON list of stages. An empty value means no stages.
+func parseStages(value string) ([]db.Stage, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	specs := []stageSpec{}
+	if err := json.Unmarshal([]byte(value), &specs); err != nil {
+		return nil, err
+	}
+
+	stages := []db.Stage{}
+	names := map[string]bool{}
+	for i, spec := range specs {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("stage #%d has no name", i+1)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("duplicate stage %q", spec.Name)
+		}
+		names[spec.Name] = true
+		if spec.Timeout < 0 {
+			return nil, fmt.Errorf("stage %q has a negative timeout", spec.Name)
+		}
+		weight := 1.0
+		if spec.Weight != nil {
+			weight = *spec.Weight
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("stage %q has a negative weight", spec.Name)
+		}
+		stages = append(stages, db.Stage{
+			Name:          spec.Name,
+			Image:         spec.Image,
+			Command:       spec.Command,
+			Timeout:       time.Duration(spec.Timeout) * time.Second,
+			Weight:        weight,
+			StopOnFailure: spec.StopOnFailure,
+		})
+	}
+	return stages, nil
+}
@@ -0,0 +1,231 @@
+package web
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/scheduler"
+)
+
+func TestParseStages(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []db.Stage
+		wantErr string
+	}{
+		{value: "", want: nil},
+		{value: "  ", want: nil},
+		{
+			value: `[{"name": "build", "command": "make", "timeout": 60, "weight": 0, "stop_on_failure": true},
+				{"name": "test", "image": "lxchecker/so-tema3:v2"}]`,
+			want: []db.Stage{
+				{Name: "build", Command: "make", Timeout: time.Minute, Weight: 0, StopOnFailure: true},
+				{Name: "test", Image: "lxchecker/so-tema3:v2", Weight: 1},
+			},
+		},
+		{value: `[{"name": "style", "weight": 0.5}]`, want: []db.Stage{{Name: "style", Weight: 0.5}}},
+		{value: `{"name": "build"}`, wantErr: "cannot unmarshal"},
+		{value: `[{"command": "make"}]`, wantErr: "stage #1 has no name"},
+		{value: `[{"name": "a"}, {"name": "a"}]`, wantErr: `duplicate stage "a"`},
+		{value: `[{"name": "a", "timeout": -1}]`, wantErr: "negative timeout"},
+		{value: `[{"name": "a", "weight": -2}]`, wantErr: "negative weight"},
+	}
+	for _, test := range tests {
+		stages, err := parseStages(test.value)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("parseStages(%q): got error %v, want %q", test.value, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseStages(%q): unexpected error %v", test.value, err)
+			continue
+		}
+		if len(stages) != len(test.want) {
+			t.Errorf("parseStages(%q) = %+v, want %+v", test.value, stages, test.want)
+			continue
+		}
+		for i := range stages {
+			if stages[i] != test.want[i] {
+				t.Errorf("parseStages(%q) = %+v, want %+v", test.value, stages, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestGetStageOptions(t *testing.T) {
+	options := scheduler.SubmitOptions{Image: "lxchecker/so-tema3", Timeout: time.Minute}
+	tests := []struct {
+		stage       db.Stage
+		wantImage   string
+		wantTimeout time.Duration
+	}{
+		{db.Stage{Name: "test"}, "lxchecker/so-tema3", time.Minute},
+		{db.Stage{Name: "style", Image: "lxchecker/checkpatch", Command: "checkpatch.pl *.c"}, "lxchecker/checkpatch", time.Minute},
+		{db.Stage{Name: "build", Command: "make", Timeout: 10 * time.Second}, "lxchecker/so-tema3", 10 * time.Second},
+	}
+	for _, test := range tests {
+		got := getStageOptions(options, test.stage)
+		if got.Image != test.wantImage || got.Timeout != test.wantTimeout || got.Command != test.stage.Command {
+			t.Errorf("%v: got image %q, timeout %v and command %q", test.stage.Name, got.Image, got.Timeout, got.Command)
+		}
+	}
+}
+
+func TestEvaluateStage(t *testing.T) {
+	tests := []struct {
+		desc          string
+		weight        float64
+		response      scheduler.SubmitResponse
+		logs          string
+		err           error
+		scoreOptional bool
+		want          db.Status
+		wantScore     int
+		wantPoints    int
+	}{
+		{
+			desc:   "weighted score",
+			weight: 0.5,
+			logs:   "@score 85\n",
+			want:   db.StatusDone, wantScore: 85, wantPoints: 43,
+		},
+		{
+			desc:   "zero weight",
+			weight: 0,
+			logs:   "@score 85\n",
+			want:   db.StatusDone, wantScore: 85, wantPoints: 0,
+		},
+		{
+			desc:     "timed out, keeping the score so far",
+			weight:   2,
+			response: scheduler.SubmitResponse{TimedOut: true},
+			logs:     "@score 10\n",
+			want:     db.StatusTimedOut, wantScore: 10, wantPoints: 20,
+		},
+		{
+			desc:     "failed results, no points",
+			weight:   1,
+			response: scheduler.SubmitResponse{Results: []byte("not json")},
+			logs:     "@score 10\n",
+			want:     db.StatusCheckerError,
+		},
+		{
+			desc:          "build without a score",
+			weight:        1,
+			scoreOptional: true,
+			want:          db.StatusDone,
+		},
+		{
+			desc:          "failed build",
+			weight:        1,
+			response:      scheduler.SubmitResponse{ExitCode: 2},
+			scoreOptional: true,
+			want:          db.StatusCheckerError,
+		},
+		{
+			desc:   "infrastructure error",
+			weight: 1,
+			err:    scheduler.InfraError{Err: errors.New("connection reset")},
+			want:   db.StatusInfraError,
+		},
+	}
+	for _, test := range tests {
+		result := &db.StageResult{}
+		stage := db.Stage{Name: "test", Weight: test.weight}
+		response := test.response
+		response.ImageDigest = "sha256:1234"
+		response.Metrics.WallTime = time.Second
+		evaluateStage(result, stage, response, []byte(test.logs), test.err, test.scoreOptional)
+		if result.Status != test.want || result.Score != test.wantScore || result.Points != test.wantPoints {
+			t.Errorf("%v: got status %q, score %d and %d points (%v), want %q, %d and %d", test.desc, result.Status, result.Score, result.Points, result.Error, test.want, test.wantScore, test.wantPoints)
+		}
+		if result.Metrics.WallTime != time.Second {
+			t.Errorf("%v: metrics not recorded", test.desc)
+		}
+		if (result.ImageDigest != "") != (test.err == nil) {
+			t.Errorf("%v: got image digest %q", test.desc, result.ImageDigest)
+		}
+	}
+}
+
+func TestRunStage(t *testing.T) {
+	tests := []struct {
+		desc       string
+		stage      db.Stage
+		last       bool
+		response   scheduler.SubmitResponse
+		err        error
+		want       db.Status
+		wantPoints int
+		wantLogs   string
+	}{
+		{
+			desc:       "last stage",
+			stage:      db.Stage{Name: "test", Weight: 1},
+			last:       true,
+			response:   scheduler.SubmitResponse{Logs: []byte("ok\n@score 90\n")},
+			want:       db.StatusDone,
+			wantPoints: 90,
+			wantLogs:   "ok\n@score 90\n",
+		},
+		{
+			desc:     "build stage without a score",
+			stage:    db.Stage{Name: "build", Command: "make", Weight: 0},
+			response: scheduler.SubmitResponse{Logs: []byte("gcc -c tema.c\n")},
+			want:     db.StatusDone,
+			wantLogs: "gcc -c tema.c\n",
+		},
+		{
+			desc:     "last stage without a score",
+			stage:    db.Stage{Name: "test", Weight: 1},
+			last:     true,
+			response: scheduler.SubmitResponse{Logs: []byte("ok\n")},
+			want:     db.StatusCheckerError,
+			wantLogs: "ok\n",
+		},
+		{
+			desc:  "checker error",
+			stage: db.Stage{Name: "test", Weight: 1},
+			last:  true,
+			err:   scheduler.CheckerError{Err: errors.New("results file too large")},
+			want:  db.StatusCheckerError,
+		},
+	}
+	for _, test := range tests {
+		executor := scheduler.NewFakeExecutor()
+		test := test
+		executor.RunFunc = func(options scheduler.SubmitOptions) (scheduler.SubmitResponse, error) {
+			return test.response, test.err
+		}
+		sched = scheduler.New(executor)
+
+		// The logs aren't saved, since the writer isn't started.
+		logs := &liveLogsWriter{s: &db.Submission{}}
+		logs.Write([]byte("==> " + test.stage.Name + "\n"))
+		result := &db.StageResult{Name: test.stage.Name}
+		options := scheduler.SubmitOptions{Image: "lxchecker/test", Timeout: time.Minute}
+		runStage(context.Background(), result, test.stage, options, logs, test.last)
+
+		if result.Status != test.want || result.Points != test.wantPoints {
+			t.Errorf("%v: got status %q and %d points (%v), want %q and %d", test.desc, result.Status, result.Points, result.Error, test.want, test.wantPoints)
+		}
+		if string(result.Logs) != test.wantLogs {
+			t.Errorf("%v: got stage logs %q, want %q", test.desc, result.Logs, test.wantLogs)
+		}
+		if want := "==> " + test.stage.Name + "\n" + test.wantLogs; string(logs.Bytes()) != want {
+			t.Errorf("%v: got logs %q, want %q", test.desc, logs.Bytes(), want)
+		}
+		runs := executor.Runs()
+		if len(runs) != 1 || runs[0].Command != test.stage.Command || runs[0].Output == nil {
+			t.Errorf("%v: got runs %+v", test.desc, runs)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package web
 
 import (
 	"fmt"
-	"html/template"
 	"net/http"
 	"regexp"
 
@@ -13,7 +12,7 @@ import (
 var (
 	validSubjectId = regexp.MustCompile(`[a-z]+[0-9a-z]+`)
 
-	subjectTmpl = template.Must(template.ParseFiles("templates/base.html", "templates/subject.html"))
+	subjectTmpl = newPage("subject.html")
 )
 
 func CreateSubjectHandler(w http.ResponseWriter, r *http.Request) {
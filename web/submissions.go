@@ -3,20 +3,24 @@ package web
 import (
 	"bytes"
 	"fmt"
-	"html/template"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"path"
 	"strconv"
 	"time"
 
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+
 	"github.com/AndreiDuma/lxchecker/db"
 	"github.com/AndreiDuma/lxchecker/scheduler"
 	"github.com/AndreiDuma/lxchecker/util"
-	"golang.org/x/net/context"
 )
 
 var (
-	submissionTmpl = template.Must(template.ParseFiles("templates/base.html", "templates/submission.html"))
+	submissionTmpl = newPage("submission.html")
 )
 
 func IsSubmissionOverdue(s *db.Submission, a *db.Assignment) bool {
@@ -42,17 +46,6 @@ func GetSubmissionOverallGrade(s *db.Submission, a *db.Assignment) int {
 func CreateSubmissionHandler(w http.ResponseWriter, r *http.Request) {
 	rd := util.GetRequestData(r)
 
-	// Get submission file from request.
-	submissionFile, submissionFileHeader, err := r.FormFile("submission")
-	if err != nil {
-		http.Error(w, "missing required `submission` field", http.StatusBadRequest)
-		return
-	}
-	submissionBytes, err := ioutil.ReadAll(submissionFile)
-	if err != nil {
-		panic(err)
-	}
-
 	assignment, err := db.GetAssignment(rd.SubjectId, rd.AssignmentId)
 	if err != nil {
 		if err == db.ErrNotFound {
@@ -62,18 +55,64 @@ func CreateSubmissionHandler(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	// Add submission to database.
+	// Get submission files from request.
+	if err := r.ParseMultipartForm(32 * megabyte); err != nil {
+		http.Error(w, "missing required `submission` field", http.StatusBadRequest)
+		return
+	}
+	fileHeaders := r.MultipartForm.File["submission"]
+	if len(fileHeaders) == 0 {
+		http.Error(w, "missing required `submission` field", http.StatusBadRequest)
+		return
+	}
+	if len(fileHeaders) > 1 && !assignment.Unpack {
+		http.Error(w, "this assignment accepts a single file", http.StatusBadRequest)
+		return
+	}
+	files := []util.File{}
+	for _, fileHeader := range fileHeaders {
+		f, err := fileHeader.Open()
+		if err != nil {
+			panic(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			panic(err)
+		}
+		files = append(files, util.File{Name: path.Base(fileHeader.Filename), Mode: 0644, Data: data})
+	}
+	submissionBytes, submissionFileName := files[0].Data, files[0].Name
+	if len(files) > 1 {
+		// Several files are kept together as an archive.
+		if submissionBytes, err = util.MakeTarGz(files); err != nil {
+			panic(err)
+		}
+		submissionFileName = "submission.tar.gz"
+	}
+
+	// Reject uploads breaking the assignment's rules right away.
+	if err := validateSubmission(assignment, submissionFileName, submissionBytes); err != nil {
+		http.Error(w, fmt.Sprintf("invalid submission: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Add submission to database, storing the upload in a file since it may
+	// not fit in the document.
+	id := db.NewSubmissionId()
 	s := &db.Submission{
-		Id:               db.NewSubmissionId(),
+		Id:               id,
 		AssignmentId:     rd.AssignmentId,
 		SubjectId:        rd.SubjectId,
 		OwnerUsername:    rd.User.Username,
 		Timestamp:        time.Now(),
-		UploadedFile:     submissionBytes,
-		UploadedFileName: submissionFileHeader.Filename,
-		Status:           "pending",
+		UploadedFileId:   db.InsertFile(fmt.Sprintf("%v-%v", id, submissionFileName), submissionBytes),
+		UploadedFileName: submissionFileName,
 	}
 	if err = db.InsertSubmission(s); err != nil {
+		if removeErr := db.RemoveFile(s.UploadedFileId); removeErr != nil {
+			log.Printf("failed to remove upload %v of submission %v: %v\n", s.UploadedFileId, s.Id, removeErr)
+		}
 		if err == db.ErrNotFound {
 			http.Error(w, "no assignment matching given `subject_id` and `assignment_id`", http.StatusBadRequest)
 			return
@@ -81,58 +120,288 @@ func CreateSubmissionHandler(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	// Do the actual testing in a separate goroutine.
-	go func() {
-		defer util.LogPanics()
+	// Queue the submission for testing.
+	if err = pool.Enqueue(s, db.JobPriorityInteractive); err != nil {
+		panic(err)
+	}
+
+	// Redirect to the newly created submission.
+	http.Redirect(w, r, fmt.Sprintf("/-/%v/%v/%v/", s.SubjectId, s.AssignmentId, s.Id), http.StatusFound)
+
+}
+
+// maxJobAttempts is the number of times a submission's job may be claimed,
+// its worker being lost every time (e.g. because the submission crashes the
+// server), before giving up on the submission.
+const maxJobAttempts = 3
 
-		// Submit for testing.
-		options := scheduler.SubmitOptions{
-			Image:          assignment.Image,
-			Submission:     submissionBytes,
-			SubmissionPath: assignment.SubmissionPath,
-			Timeout:        assignment.Timeout,
+// RunSubmissionJob does the actual testing of a queued submission, running
+// the stages of its assignment's pipeline in order. It is run by the
+// scheduler's workers.
+func RunSubmissionJob(ctx context.Context, job *db.Job) {
+	s, err := db.GetSubmission(job.SubjectId, job.AssignmentId, job.SubmissionId)
+	if err != nil {
+		if err == db.ErrNotFound {
+			log.Printf("job %v: submission %v no longer exists\n", job.Id, job.SubmissionId)
+			return
 		}
-		response, err := sched.Submit(context.Background(), options)
-		if err != nil {
-			s.Status = "failed"
-			db.UpdateSubmission(s)
+		panic(err)
+	}
+	if s.Status == db.StatusRunning {
+		// The worker running it before was lost.
+		if err := db.RequeueSubmission(s, "worker lost"); err != nil && err != db.ErrNotFound {
+			panic(err)
+		}
+	}
+	if job.Attempts > maxJobAttempts {
+		log.Printf("job %v: giving up after %d attempts\n", job.Id, maxJobAttempts)
+		if err := db.GiveUpSubmission(s, fmt.Sprintf("run interrupted %d times", maxJobAttempts)); err != nil && err != db.ErrNotFound {
+			panic(err)
+		}
+		return
+	}
+	if err := db.StartSubmission(s); err != nil {
+		if err == db.ErrNotFound {
+			// Cancelled while queued.
+			return
+		}
+		panic(err)
+	}
+	// The result of a previous run, kept in the history, stays in effect
+	// until this one finishes.
+	clearResults(s)
+	assignment, err := db.GetAssignment(s.SubjectId, s.AssignmentId)
+	if err != nil {
+		if err == db.ErrNotFound {
+			log.Printf("job %v: assignment %v no longer exists\n", job.Id, job.AssignmentId)
+			db.FinishSubmission(s, db.StatusInfraError, "assignment no longer exists")
 			return
 		}
+		panic(err)
+	}
+
+	options, err := getSubmitOptions(s, assignment)
+	if err != nil {
+		// Submissions that can't be unpacked are to blame, unlike e.g.
+		// missing fixtures.
+		status := db.StatusInfraError
+		if _, ok := err.(scheduler.CheckerError); ok {
+			status = db.StatusCheckerError
+		}
+		db.FinishSubmission(s, status, err.Error())
+		return
+	}
+
+	// Run the stages, saving the logs as they are produced.
+	stages := getStages(assignment)
+	s.Stages = []db.StageResult{}
+	for _, stage := range stages {
+		s.Stages = append(s.Stages, db.StageResult{Name: stage.Name, Status: db.StatusQueued})
+	}
+	liveLogs := newLiveLogsWriter(s)
+	artifacts := []scheduler.Artifact{}
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	logsTruncated := false
+	stop := false
+	for i, stage := range stages {
+		result := &s.Stages[i]
+		if stop {
+			result.Status = db.StatusSkipped
+			continue
+		}
+		result.Status = db.StatusRunning
+		db.UpdateSubmissionStages(s)
 
-		// Store logs and metadata, then extract score.
-		s.Logs = response.Logs
-		s.Metadata = getMetadataFromLogs(response.Logs)
-		if s.ScoreByTests, err = strconv.Atoi(s.Metadata["score"]); err != nil {
-			s.Status = "failed"
-			db.UpdateSubmission(s)
+		if len(stages) > 1 {
+			for _, w := range []io.Writer{liveLogs, stdout, stderr} {
+				fmt.Fprintf(w, "==> %v\n", stage.Name)
+			}
+		}
+		response := runStage(ctx, result, stage, options, liveLogs, i == len(stages)-1)
+		if ctx.Err() != nil {
+			// The job was taken over by another worker, leave the
+			// submission alone.
+			liveLogs.Close()
 			return
 		}
 
-		s.Status = "done"
-		db.UpdateSubmission(s)
-	}()
+		// Keep the output even if the run failed midway.
+		stdout.Write(response.Stdout)
+		stderr.Write(response.Stderr)
+		logsTruncated = logsTruncated || response.LogsTruncated
+		artifacts = append(artifacts, response.Artifacts...)
+		stop = result.Status != db.StatusDone && stage.StopOnFailure
+	}
+	liveLogs.Close()
 
-	// Redirect to the newly created submission.
-	http.Redirect(w, r, fmt.Sprintf("/-/%v/%v/%v/", s.SubjectId, s.AssignmentId, s.Id), http.StatusFound)
+	// Gather logs, metadata, test results, artifacts and score from the
+	// stages.
+	s.Logs, s.LogsFileId = storeLog(s, "logs", liveLogs.Bytes())
+	s.LogsRun = liveLogs.Run()
+	s.Stdout, s.StdoutFileId = storeLog(s, "stdout", stdout.Bytes())
+	s.Stderr, s.StderrFileId = storeLog(s, "stderr", stderr.Bytes())
+	s.LogsTruncated = logsTruncated
+	s.ImageDigest = ""
+	s.Metadata = map[string]string{}
+	s.Tests = []db.TestResult{}
+	s.ScoreByTests = 0
+	s.Metrics = db.Metrics{}
+	status, reason := db.StatusDone, ""
+	for _, result := range s.Stages {
+		if s.ImageDigest == "" {
+			s.ImageDigest = result.ImageDigest
+		}
+		for key, value := range result.Metadata {
+			s.Metadata[key] = value
+		}
+		s.Tests = append(s.Tests, result.Tests...)
+		s.ScoreByTests += result.Points
+		s.Metrics.WallTime += result.Metrics.WallTime
+		s.Metrics.CPUTime += result.Metrics.CPUTime
+		if result.Metrics.PeakMemory > s.Metrics.PeakMemory {
+			s.Metrics.PeakMemory = result.Metrics.PeakMemory
+		}
+		s.Metrics.OOMKilled = s.Metrics.OOMKilled || result.Metrics.OOMKilled
+
+		// The submission ends in the status of the first stage that
+		// didn't succeed.
+		if status == db.StatusDone && result.Status.IsFailure() {
+			status, reason = result.Status, result.Error
+			if len(s.Stages) > 1 {
+				reason = fmt.Sprintf("stage %v: %v", result.Name, reason)
+			}
+		}
+	}
+	storeArtifacts(s, assignment, artifacts)
+	if err := db.FinishSubmission(s, status, reason); err == db.ErrNotFound {
+		// Cancelled just before finishing, the results are no longer
+		// wanted.
+		log.Printf("job %v: submission %v was cancelled, dropping results\n", job.Id, s.Id)
+		removeSubmissionFiles(s)
+	}
+}
 
+// clearResults drops the result of a previous run from `s`, so that it isn't
+// saved again along with the outcome of the new one.
+func clearResults(s *db.Submission) {
+	s.Logs, s.Stdout, s.Stderr = nil, nil, nil
+	s.LogsTruncated = false
+	s.LogsFileId, s.StdoutFileId, s.StderrFileId = "", "", ""
+	s.Metadata = nil
+	s.Tests = nil
+	s.Artifacts = nil
+	s.Stages = nil
+	s.ImageDigest = ""
+	s.ScoreByTests = 0
+	s.Metrics = db.Metrics{}
 }
 
-func getMetadataFromLogs(logs []byte) map[string]string {
-	metadata := map[string]string{}
-	lines := bytes.Split(logs, []byte("\n"))
-	for _, line := range lines {
-		line = bytes.TrimSpace(line)
-		if !bytes.HasPrefix(line, []byte("@")) {
+// removeSubmissionFiles removes the files holding the logs and artifacts of
+// `s`.
+func removeSubmissionFiles(s *db.Submission) {
+	fileIds := []string{s.LogsFileId, s.StdoutFileId, s.StderrFileId}
+	for _, artifact := range s.Artifacts {
+		fileIds = append(fileIds, artifact.FileId)
+	}
+	for _, fileId := range fileIds {
+		if fileId == "" {
 			continue
 		}
-		line = bytes.TrimLeft(line, "@")
-		parts := bytes.SplitN(line, []byte(" "), 2)
-		if len(parts) != 2 {
-			continue
+		if err := db.RemoveFile(fileId); err != nil {
+			log.Printf("failed to remove file %v of submission %v: %v\n", fileId, s.Id, err)
+		}
+	}
+}
+
+// CancelSubmissionHandler stops a queued or running submission. Only its
+// owner and teachers may do so.
+func CancelSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	rd := util.GetRequestData(r)
+	s := getSubmissionHelper(w, r)
+	if s == nil {
+		return
+	}
+	if s.OwnerUsername != rd.User.Username && !rd.UserIsTeacher && !rd.UserIsAdmin {
+		http.Error(w, "only the owner or a teacher can cancel a submission", http.StatusForbidden)
+		return
+	}
+
+	if err := db.CancelSubmission(s, rd.User.Username); err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "submission is no longer queued or running", http.StatusBadRequest)
+			return
 		}
-		metadata[string(parts[0])] = string(parts[1])
+		panic(err)
+	}
+	// The job may have just finished, in which case there's nothing to stop.
+	if err := pool.Cancel(s.SubjectId, s.AssignmentId, s.Id); err != nil && err != db.ErrNotFound {
+		panic(err)
+	}
+
+	// Redirect back to the submission.
+	http.Redirect(w, r, fmt.Sprintf("/-/%v/%v/%v/", s.SubjectId, s.AssignmentId, s.Id), http.StatusFound)
+}
+
+// getSubmitOptions describes how submission `s` is to be run according to the
+// settings of its assignment `a`. A scheduler.CheckerError is returned if the
+// submission can't be unpacked.
+func getSubmitOptions(s *db.Submission, a *db.Assignment) (scheduler.SubmitOptions, error) {
+	ulimits := []scheduler.Ulimit{}
+	for _, u := range a.Ulimits {
+		ulimits = append(ulimits, scheduler.Ulimit{
+			Name: u.Name,
+			Soft: u.Soft,
+			Hard: u.Hard,
+		})
+	}
+	upload, err := getUpload(s)
+	if err != nil {
+		return scheduler.SubmitOptions{}, fmt.Errorf("couldn't get the submission: %v", err)
+	}
+	options := scheduler.SubmitOptions{
+		Image:          a.Image,
+		PullPolicy:     scheduler.PullPolicy(a.PullPolicy),
+		Submission:     upload,
+		SubmissionPath: a.SubmissionPath,
+		Timeout:        a.Timeout,
+		Resources: scheduler.Resources{
+			Memory:    a.MemoryLimit,
+			CPUs:      a.CPULimit,
+			PidsLimit: a.PidsLimit,
+			Ulimits:   ulimits,
+			TmpfsSize: a.TmpfsSize,
+			DiskSize:  a.DiskSize,
+		},
+		Security:   getSecurity(a),
+		Network:    a.Network,
+		Artifacts:  artifactPaths(a),
+		MaxLogSize: a.MaxLogSize,
+	}
+
+	// Archives are unpacked again rather than stored unpacked.
+	if a.Unpack && util.IsArchive(s.UploadedFileName) {
+		files, err := unpackSubmission(a, s.UploadedFileName, upload)
+		if err != nil {
+			return options, scheduler.CheckerError{Err: fmt.Errorf("invalid submission: %v", err)}
+		}
+		options.SubmissionFiles = files
 	}
-	return metadata
+
+	fixtures, err := getFixtures(a)
+	if err != nil {
+		return options, fmt.Errorf("couldn't get test fixtures: %v", err)
+	}
+	options.Fixtures = fixtures
+	options.FixturesPath = a.FixturesPath
+	return options, nil
+}
+
+// getUpload returns the file uploaded for submission `s`.
+func getUpload(s *db.Submission) ([]byte, error) {
+	if s.UploadedFileId == "" {
+		return s.UploadedFile, nil
+	}
+	return db.GetFile(s.UploadedFileId)
 }
 
 func getSubmissionHelper(w http.ResponseWriter, r *http.Request) *db.Submission {
@@ -150,6 +419,22 @@ func getSubmissionHelper(w http.ResponseWriter, r *http.Request) *db.Submission
 	return submission
 }
 
+// getResultHelper returns the result of the latest run of `s`, or of the
+// previous run at `history_index` if given.
+func getResultHelper(w http.ResponseWriter, r *http.Request, s *db.Submission) *db.PastResult {
+	index, ok := mux.Vars(r)["history_index"]
+	if !ok {
+		result := s.Result()
+		return &result
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 || i >= len(s.History) {
+		http.Error(w, "no previous result matching given `history_index`", http.StatusNotFound)
+		return nil
+	}
+	return &s.History[i]
+}
+
 func GetSubmissionHandler(w http.ResponseWriter, r *http.Request) {
 	s := getSubmissionHelper(w, r)
 	if s == nil {
@@ -184,9 +469,17 @@ func GetSubmissionUploadHandler(w http.ResponseWriter, r *http.Request) {
 	if s == nil {
 		return
 	}
+	upload, err := getUpload(s)
+	if err != nil {
+		if err == db.ErrNotFound {
+			http.Error(w, "submission file no longer exists", http.StatusNotFound)
+			return
+		}
+		panic(err)
+	}
 	// TODO: make the downloaded submission have at least the same extension as the uploaded one.
 	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, s.UploadedFileName))
-	w.Write(s.UploadedFile)
+	w.Write(upload)
 }
 
 func GradeSubmissionHandler(w http.ResponseWriter, r *http.Request) {
@@ -212,7 +505,7 @@ func GradeSubmissionHandler(w http.ResponseWriter, r *http.Request) {
 	// Mark as graded.
 	s.GradedByTeacher = true
 
-	if err := db.UpdateSubmission(s); err != nil {
+	if err := db.GradeSubmission(s); err != nil {
 		if err == db.ErrNotFound {
 			http.Error(w, "no submission matching given `subject_id`, `assignment_id` and `submission_id`", http.StatusNotFound)
 			return
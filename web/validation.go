@@ -0,0 +1,108 @@
+package web
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/AndreiDuma/lxchecker/db"
+	"github.com/AndreiDuma/lxchecker/util"
+)
+
+// Limits applied to uploads of assignments that don't set their own.
+const (
+	defaultMaxSubmissionSize = 64 * megabyte
+	defaultMaxFileCount      = 1000
+)
+
+func maxSubmissionSize(a *db.Assignment) int64 {
+	if a.MaxSubmissionSize > 0 {
+		return a.MaxSubmissionSize
+	}
+	return defaultMaxSubmissionSize
+}
+
+func maxFileCount(a *db.Assignment) int {
+	if a.MaxFileCount > 0 {
+		return a.MaxFileCount
+	}
+	return defaultMaxFileCount
+}
+
+// unpackSubmission returns the files of the uploaded file `data` named
+// `name`. Archives are unpacked if the assignment asks for it, anything
+// else is a single file. Unpacking fails if the assignment's limits are
+// exceeded.
+func unpackSubmission(a *db.Assignment, name string, data []byte) ([]util.File, error) {
+	if int64(len(data)) > maxSubmissionSize(a) {
+		return nil, fmt.Errorf("submission larger than %d bytes", maxSubmissionSize(a))
+	}
+	if !a.Unpack || !util.IsArchive(name) {
+		return []util.File{{Name: path.Base(name), Mode: 0644, Data: data}}, nil
+	}
+	files, err := util.ExtractArchive(name, data, maxSubmissionSize(a), maxFileCount(a))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("empty archive")
+	}
+	return files, nil
+}
+
+// validateSubmission checks the uploaded file `data` named `name` against
+// the rules of assignment `a`, returning a message meant for the student if
+// it breaks any of them.
+func validateSubmission(a *db.Assignment, name string, data []byte) error {
+	files, err := unpackSubmission(a, name, data)
+	if err != nil {
+		return err
+	}
+	for _, pattern := range a.RequiredFiles {
+		found := false
+		for _, f := range files {
+			if matchFile(pattern, f.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("missing required file %q", pattern)
+		}
+	}
+	for _, pattern := range a.ForbiddenFiles {
+		for _, f := range files {
+			if matchFile(pattern, f.Name) {
+				return fmt.Errorf("forbidden file %v (matches %q)", f.Name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// matchFile checks whether the file `name` matches the glob `pattern`.
+// Patterns without slashes are matched against the base name, so that they
+// apply at any depth.
+func matchFile(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	matched, _ := path.Match(strings.TrimPrefix(pattern, "/"), name)
+	return matched
+}
+
+// parseFilePatterns parses a comma-separated list of glob patterns.
+func parseFilePatterns(value string) ([]string, error) {
+	patterns := []string{}
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern: %q", pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -17,18 +18,43 @@ import (
 
 var (
 	sched *scheduler.Scheduler
+	pool  *scheduler.Pool
 
 	router = mux.NewRouter().StrictSlash(true)
 )
 
 func Start() {
-	// Connect to Docker.
-	sched = scheduler.New()
+	// Fail early on malformed templates.
+	parsePages()
+
+	// Set up the backend running submissions.
+	executor, err := scheduler.NewExecutor(os.Getenv("LXCHECKER_EXECUTOR"))
+	if err != nil {
+		log.Fatalf("failed to set up executor: %v\n", err)
+	}
+	sched = scheduler.New(executor)
 
 	// Connect to MongoDB.
 	// TODO: customizable Mongo host.
 	db.Init()
 
+	// Builds don't survive restarts.
+	db.FailInterruptedBuilds()
+
+	// Docker hosts missing built images build them as they come up.
+	sched.SetBuiltImages(builtImages)
+
+	// Start the workers running submissions.
+	workers, _ := strconv.Atoi(os.Getenv("LXCHECKER_WORKERS"))
+	maxPerUser, _ := strconv.Atoi(os.Getenv("LXCHECKER_MAX_JOBS_PER_USER"))
+	maxPerAssignment, _ := strconv.Atoi(os.Getenv("LXCHECKER_MAX_JOBS_PER_ASSIGNMENT"))
+	pool = scheduler.NewPool(RunSubmissionJob, scheduler.PoolOptions{
+		Workers:          workers,
+		MaxPerUser:       maxPerUser,
+		MaxPerAssignment: maxPerAssignment,
+	})
+	pool.Start()
+
 	// Setup handlers.
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
 	// TODO: wrap router with gorrila/handlers/recovery handler.
@@ -39,19 +65,37 @@ func Start() {
 	router.HandleFunc("/login", LoginHandler).Methods("POST")
 	router.HandleFunc("/signup", SignupHandler).Methods("POST")
 	router.HandleFunc("/logout", LogoutHandler).Methods("GET") // TODO: make this POST.
+	router.HandleFunc("/health", HealthHandler).Methods("GET")
 	router.Handle("/add_admin", util.RequireAuth(util.RequireAdmin(http.HandlerFunc(AddAdminHandler)))).Methods("POST")
 
 	sub := router.PathPrefix("/-/").Subrouter()
 	sub.Handle("/", util.RequireAuth(http.HandlerFunc(IndexHandler))).Methods("GET")
 	sub.Handle("/{subject_id}/", util.RequireAuth(http.HandlerFunc(GetSubjectHandler))).Methods("GET")
 	sub.Handle("/{subject_id}/{assignment_id}/", util.RequireAuth(http.HandlerFunc(GetAssignmentHandler))).Methods("GET")
+	// Registered before the submission routes, whose `submission_id` would match them.
+	sub.Handle("/{subject_id}/{assignment_id}/fixtures", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(GetAssignmentFixturesHandler)))).Methods("GET")
+	sub.Handle("/{subject_id}/{assignment_id}/update_fixtures", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(UpdateAssignmentFixturesHandler)))).Methods("POST")
 	sub.Handle("/{subject_id}/{assignment_id}/{submission_id}/", util.RequireAuth(http.HandlerFunc(GetSubmissionHandler))).Methods("GET")
+	sub.Handle("/{subject_id}/{assignment_id}/{submission_id}/events", util.RequireAuth(http.HandlerFunc(GetSubmissionEventsHandler))).Methods("GET")
+	sub.Handle("/{subject_id}/{assignment_id}/{submission_id}/artifacts/{artifact_index}", util.RequireAuth(http.HandlerFunc(GetSubmissionArtifactHandler))).Methods("GET")
+	sub.Handle("/{subject_id}/{assignment_id}/{submission_id}/logs/{stream}", util.RequireAuth(http.HandlerFunc(GetSubmissionLogsHandler))).Methods("GET")
+	sub.Handle("/{subject_id}/{assignment_id}/{submission_id}/history/{history_index}/artifacts/{artifact_index}", util.RequireAuth(http.HandlerFunc(GetSubmissionArtifactHandler))).Methods("GET")
+	sub.Handle("/{subject_id}/{assignment_id}/{submission_id}/history/{history_index}/logs/{stream}", util.RequireAuth(http.HandlerFunc(GetSubmissionLogsHandler))).Methods("GET")
 	sub.Handle("/{subject_id}/{assignment_id}/{submission_id}/upload", util.RequireAuth(http.HandlerFunc(GetSubmissionUploadHandler))).Methods("GET")
+	sub.Handle("/{subject_id}/{assignment_id}/{submission_id}/debug", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(DebugSubmissionHandler)))).Methods("GET")
+	sub.Handle("/{subject_id}/{assignment_id}/{submission_id}/debug/socket", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(DebugSubmissionSocketHandler)))).Methods("GET")
 
 	sub.Handle("/create_subject", util.RequireAuth(util.RequireAdmin(http.HandlerFunc(CreateSubjectHandler)))).Methods("POST")
 	sub.Handle("/{subject_id}/create_assignment", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(CreateAssignmentHandler)))).Methods("POST")
+	sub.Handle("/{subject_id}/{assignment_id}/regrade", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(RegradeAssignmentHandler)))).Methods("POST")
+	sub.Handle("/{subject_id}/{assignment_id}/regrades/{regrade_id}", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(GetRegradeHandler)))).Methods("GET")
+	sub.Handle("/{subject_id}/{assignment_id}/build_image", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(BuildAssignmentImageHandler)))).Methods("POST")
+	sub.Handle("/{subject_id}/{assignment_id}/builds/{build_id}", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(GetBuildHandler)))).Methods("GET")
+	sub.Handle("/{subject_id}/{assignment_id}/builds/{build_id}/bundle", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(GetBuildBundleHandler)))).Methods("GET")
+	sub.Handle("/{subject_id}/{assignment_id}/update_image", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(UpdateAssignmentImageHandler)))).Methods("POST")
 	sub.Handle("/{subject_id}/add_teacher", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(AddTeacherHandler)))).Methods("POST")
 	sub.Handle("/{subject_id}/{assignment_id}/create_submission", util.RequireAuth(http.HandlerFunc(CreateSubmissionHandler))).Methods("POST")
+	sub.Handle("/{subject_id}/{assignment_id}/{submission_id}/cancel_submission", util.RequireAuth(http.HandlerFunc(CancelSubmissionHandler))).Methods("POST")
 	sub.Handle("/{subject_id}/{assignment_id}/{submission_id}/grade_submission", util.RequireAuth(util.RequireTeacherOrAdmin(http.HandlerFunc(GradeSubmissionHandler)))).Methods("POST")
 
 	// TODO: receive this through a command-line argument.